@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"net/http"
+	"strings"
+)
+
+// maxJSONBytes is the largest JSON request body accepted by the v1 API. It allows for a manifest of maxBundleFiles.
+const maxJSONBytes = 1 << 20
+
+// InitUploadResponse is the response of /v1/init-upload
+type InitUploadResponse struct {
+	TransferID int64             `json:"transfer_id"`
+	PublicKeys map[string]string `json:"public_keys"`
+	// public keys of the registered devices of each friend by code and device ID
+	DeviceKeys map[string]map[string]string `json:"device_keys"`
+	// whether each friend is connected so the transfer can be sent directly with Signal by code
+	Online map[string]bool `json:"online"`
+}
+
+// CompleteDownloadRequest is the request of /v1/completed-download. An empty hash marks the download as failed.
+type CompleteDownloadRequest struct {
+	FilePath string `json:"file_path"`
+	Hash     string `json:"hash"`
+}
+
+// PasswordResponse is the response of /v1/completed-download
+type PasswordResponse struct {
+	Password string `json:"password"`
+}
+
+// CreditRequest is the request of /v1/register
+type CreditRequest struct {
+	CreditCode string `json:"credit_code"`
+}
+
+// CustomCodeRequest is the request of /v1/custom-code
+type CustomCodeRequest struct {
+	CustomCode string `json:"custom_code"`
+}
+
+// ChallengeRequest is the request of /v1/challenge
+type ChallengeRequest struct {
+	UUID string `json:"UUID"`
+}
+
+// V1Router is the JSON API. Requests and responses are JSON apart from file uploads and downloads which use the same
+// multipart and binary bodies as the form endpoints. Users authenticate with the UUID and UUID-key, Authorization or
+// Challenge and Signature headers.
+func (s *Server) V1Router() http.Handler {
+	r := chi.NewRouter()
+	r.HandleFunc("/code", s.V1CreateCodeHandler)
+	r.HandleFunc("/token", s.TokenHandler)
+	r.HandleFunc("/challenge", s.V1ChallengeHandler)
+	r.HandleFunc("/init-upload", s.V1InitUploadHandler)
+	r.HandleFunc("/upload-file", s.UploadFileHandler)
+	r.HandleFunc("/upload-chunk", s.UploadChunkHandler)
+	r.HandleFunc("/upload-status", s.UploadStatusHandler)
+	r.HandleFunc("/upload-complete", s.V1UploadCompleteHandler)
+	r.HandleFunc("/download", s.DownloadHandler)
+	r.HandleFunc("/completed-download", s.V1CompletedDownloadHandler)
+	r.HandleFunc("/register", s.V1RegisterCreditHandler)
+	r.HandleFunc("/toggle-perm-code", s.V1TogglePermCodeHandler)
+	r.HandleFunc("/custom-code", s.V1CustomCodeHandler)
+	r.HandleFunc("/register-device", s.V1RegisterDeviceHandler)
+	r.HandleFunc("/devices", s.DevicesHandler)
+	r.HandleFunc("/remove-device", s.V1RemoveDeviceHandler)
+	r.HandleFunc("/answer-offer", s.V1AnswerOfferHandler)
+	r.HandleFunc("/cancel", s.V1CancelHandler)
+	r.HandleFunc("/transfers", s.V1TransfersHandler)
+	r.HandleFunc("/transfer-events", s.V1TransferEventsHandler)
+	return r
+}
+
+// readJSON decodes the JSON body of a POST request into v writing an error if the request is invalid
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return false
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		WriteError(w, r, ErrInvalidForm.WithMessage("Expected Content-Type application/json"))
+		return false
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		WriteError(w, r, ErrInvalidForm.WithMessage("Invalid JSON: "+err.Error()))
+		return false
+	}
+	return true
+}
+
+// writeJSONResult writes v or err if there is one
+func writeJSONResult(w http.ResponseWriter, r *http.Request, v interface{}, err error) {
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	Handle(WriteJSON(w, v))
+}
+
+// V1CreateCodeHandler is the JSON handler for CreateCode
+func (s *Server) V1CreateCodeHandler(w http.ResponseWriter, r *http.Request) {
+	var req CodeRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, err := s.CreateCode(req)
+	writeJSONResult(w, r, user, err)
+}
+
+// V1ChallengeHandler is the JSON handler for NewChallenge
+func (s *Server) V1ChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	var req ChallengeRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	challenge, err := s.NewChallenge(User{UUID: req.UUID})
+	writeJSONResult(w, r, challenge, err)
+}
+
+// V1InitUploadHandler is the JSON handler for InitUpload
+func (s *Server) V1InitUploadHandler(w http.ResponseWriter, r *http.Request) {
+	var req InitUploadRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	transfer, publicKeys, err := s.InitUpload(user, req)
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	writeJSONResult(w, r, InitUploadResponse{transfer.ID, publicKeys, s.DeviceKeys(req.Codes),
+		s.OnlineFriends(req.Codes)}, nil)
+}
+
+// V1UploadCompleteHandler is the JSON handler for CompleteUpload
+func (s *Server) V1UploadCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	var req CompleteUploadRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	writeJSONResult(w, r, nil, s.CompleteUpload(user, req))
+}
+
+// V1CompletedDownloadHandler is the JSON handler for CompleteDownload
+func (s *Server) V1CompletedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	var req CompleteDownloadRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	password, err := s.CompleteDownload(user, req.FilePath, req.Hash)
+	writeJSONResult(w, r, PasswordResponse{password}, err)
+}
+
+// V1RegisterCreditHandler is the JSON handler for RegisterCredit
+func (s *Server) V1RegisterCreditHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreditRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	writeJSONResult(w, r, nil, s.RegisterCredit(user, req.CreditCode))
+}
+
+// V1TogglePermCodeHandler is the JSON handler for TogglePermCode
+func (s *Server) V1TogglePermCodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	user, err := s.TogglePermCode(user)
+	writeJSONResult(w, r, user, err)
+}
+
+// V1CustomCodeHandler is the JSON handler for CustomCode
+func (s *Server) V1CustomCodeHandler(w http.ResponseWriter, r *http.Request) {
+	var req CustomCodeRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	user, err := s.CustomCode(user, req.CustomCode)
+	writeJSONResult(w, r, user, err)
+}
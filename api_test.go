@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func v1User(t *testing.T) (user User, header http.Header) {
+	UUID := uuid.New().String()
+	rr := postJSON(CodeRequest{UUID: UUID, PublicKey: testB64PubKey}, nil, http.HandlerFunc(s.V1CreateCodeHandler))
+	if err := json.Unmarshal(rr.Body.Bytes(), &user); rr.Code != 200 || err != nil || user.UUIDKey == "" {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	user.UUID = UUID
+	time.Sleep(time.Millisecond * time.Duration(10))
+	header = http.Header{}
+	header.Set("UUID", UUID)
+	header.Set("UUID-key", user.UUIDKey)
+	return
+}
+
+func TestV1TransferCycle(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+
+	fileBytes := []byte(RandomString(100))
+
+	rr := postJSON(InitUploadRequest{Filesize: len(fileBytes), Codes: []string{user2.Code}}, header1,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var initUpload InitUploadResponse
+	_ = json.Unmarshal(rr.Body.Bytes(), &initUpload)
+	if rr.Code != 200 || initUpload.TransferID == 0 || initUpload.PublicKeys[user2.Code] != testB64PubKey {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	credentials := url.Values{}
+	credentials.Set("UUID", user1.UUID)
+	credentials.Set("UUID_key", user1.UUIDKey)
+	transferID := strconv.FormatInt(initUpload.TransferID, 10)
+	rr = uploadChunk(credentials, transferID, 0, fileBytes)
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	password := RandomString(10)
+	rr = postJSON(CompleteUploadRequest{
+		TransferID: initUpload.TransferID,
+		Filename:   "foo.bar",
+		Passwords:  map[string]string{"password": password},
+	}, header1, http.HandlerFunc(s.V1UploadCompleteHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+
+	_, _, ws, _ := connectWSSHeader(func() http.Header { header2.Set("Version", "1.0"); return header2 }())
+	message := readSocketMessage(ws)
+	ws.Close()
+	if message.Download == nil {
+		t.Fatalf("expected download message got %v", message)
+	}
+
+	rr = postRequestWithHeader(url.Values{"file_path": {message.Download.FilePath}}, header2,
+		http.HandlerFunc(s.DownloadHandler))
+	if rr.Body.String() != string(fileBytes) {
+		t.Errorf("Got %v expected %v", rr.Body.String(), string(fileBytes))
+	}
+
+	rr = postJSON(CompleteDownloadRequest{FilePath: message.Download.FilePath, Hash: HashWithBytes(fileBytes)}, header2,
+		http.HandlerFunc(s.V1CompletedDownloadHandler))
+	var passwordResponse PasswordResponse
+	_ = json.Unmarshal(rr.Body.Bytes(), &passwordResponse)
+	if rr.Code != 200 || passwordResponse.Password != password {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, password)
+	}
+}
+
+func TestV1Errors(t *testing.T) {
+	user, header := v1User(t)
+
+	// legacy form body
+	rr := postRequestWithHeader(url.Values{"custom_code": {"foo"}}, header, http.HandlerFunc(s.V1CustomCodeHandler))
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrInvalidForm.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+
+	rr = postJSON(map[string]string{"foo": "bar"}, header, http.HandlerFunc(s.V1CustomCodeHandler))
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrInvalidForm.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+
+	rr = postJSON(CustomCodeRequest{CustomCode: RandomString(codeLen)}, nil, http.HandlerFunc(s.V1CustomCodeHandler))
+	if e := readError(rr); rr.Code != 401 || e.Code != ErrInvalidCredentials.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	rr = postJSON(CustomCodeRequest{CustomCode: RandomString(codeLen)}, header, http.HandlerFunc(s.V1CustomCodeHandler))
+	if e := readError(rr); rr.Code != 402 || e.Code != ErrInsufficientCredit.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 402)
+	}
+
+	rr = postJSON(InitUploadRequest{Filesize: 10, Codes: []string{user.Code}}, header,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrSendToSelf.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+
+	rr = postJSON(InitUploadRequest{Files: []TransferFile{{Path: "../foo"}}, Codes: []string{user.Code}}, header,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrInvalidManifest.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+}
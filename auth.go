@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenLifeMins     = 15
+	challengeBytes    = 32
+	challengeLifeMins = 2
+
+	authMethodKey       = "key"
+	authMethodToken     = "token"
+	authMethodChallenge = "challenge"
+)
+
+type contextKey string
+
+const authContextKey contextKey = "auth"
+
+// Auth is the result of authenticating a request
+type Auth struct {
+	User   User
+	Method string
+}
+
+// Authenticator resolves the user making a request
+type Authenticator interface {
+	Authenticate(db *sql.DB, r *http.Request) (User, bool)
+	Method() string
+}
+
+// Authenticators are tried in order until one of them authenticates the request
+var Authenticators = []Authenticator{
+	TokenAuthenticator{},
+	ChallengeAuthenticator{},
+	KeyAuthenticator{},
+}
+
+// KeyAuthenticator authenticates with the UUID and UUID_key of a user from either the form or the headers
+type KeyAuthenticator struct{}
+
+// Method of authentication
+func (KeyAuthenticator) Method() string { return authMethodKey }
+
+// Authenticate validates the UUID and UUID key against the user table
+func (KeyAuthenticator) Authenticate(db *sql.DB, r *http.Request) (User, bool) {
+	user := User{
+		UUID:    r.Form.Get("UUID"),
+		UUIDKey: r.Form.Get("UUID_key"),
+	}
+	if user.UUID == "" {
+		user.UUID = r.Header.Get("UUID")
+		user.UUIDKey = r.Header.Get("UUID-key")
+	}
+	if user.UUID == "" || !user.IsValid(db) {
+		return User{}, false
+	}
+	return user, true
+}
+
+// TokenAuthenticator authenticates with a bearer token created by NewToken
+type TokenAuthenticator struct{}
+
+// Method of authentication
+func (TokenAuthenticator) Method() string { return authMethodToken }
+
+// Authenticate verifies the bearer token and that the user still exists
+func (TokenAuthenticator) Authenticate(db *sql.DB, r *http.Request) (User, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return User{}, false
+	}
+	user, err := ParseToken(token, time.Now())
+	if err != nil {
+		return User{}, false
+	}
+	if _, exists := user.GetUUIDKey(db); !exists {
+		return User{}, false
+	}
+	return user, true
+}
+
+// challenges maps an issued challenge to the hashed UUID of the user it was issued for
+var challenges = cache.New(time.Minute*challengeLifeMins, time.Minute*5)
+
+// challengesMu makes checking that a challenge has not been used and using it a single step
+var challengesMu sync.Mutex
+
+// consumeChallenge removes the challenge returning whether it was issued for the user with hashedUUID and had not
+// been used yet
+func consumeChallenge(challenge, hashedUUID string) bool {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	issuedFor, ok := challenges.Get(challenge)
+	if !ok || issuedFor.(string) != hashedUUID {
+		return false
+	}
+	challenges.Delete(challenge)
+	return true
+}
+
+// ChallengeAuthenticator authenticates with a challenge from ChallengeHandler signed by the private key of the user.
+// The signature is a base64 RSA PKCS #1 v1.5 signature of the SHA-256 hash of the challenge. The challenge, signature
+// and UUID are read from either the form or the Challenge, Signature and UUID headers.
+type ChallengeAuthenticator struct{}
+
+// Method of authentication
+func (ChallengeAuthenticator) Method() string { return authMethodChallenge }
+
+// Authenticate verifies the signature of the challenge with the public key of the user. A challenge can only be
+// used once and is only used up by a valid signature.
+func (ChallengeAuthenticator) Authenticate(db *sql.DB, r *http.Request) (User, bool) {
+	user := User{UUID: r.Form.Get("UUID")}
+	challenge := r.Form.Get("challenge")
+	signature := r.Form.Get("signature")
+	if challenge == "" {
+		user.UUID = r.Header.Get("UUID")
+		challenge = r.Header.Get("Challenge")
+		signature = r.Header.Get("Signature")
+	}
+	if user.UUID == "" || challenge == "" || signature == "" {
+		return User{}, false
+	}
+
+	hashedUUID, ok := challenges.Get(challenge)
+	if !ok || hashedUUID.(string) != Hash(user.UUID) {
+		return User{}, false
+	}
+
+	if !user.GetPublicKey(db) {
+		return User{}, false
+	}
+	if err := VerifySignature(user.PublicKey, challenge, signature); err != nil {
+		return User{}, false
+	}
+	if !consumeChallenge(challenge, Hash(user.UUID)) {
+		// used by another request while the signature was being verified
+		return User{}, false
+	}
+	return user, true
+}
+
+// VerifySignature checks signature is the base64 signature of message created with the private key of the base64
+// publicKey
+func VerifySignature(publicKey, message, signature string) error {
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("not an RSA public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(message))
+	return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed[:], sig)
+}
+
+type tokenPayload struct {
+	UUID   string `json:"uuid"`
+	Expiry int64  `json:"exp"`
+}
+
+// envKeys splits a comma separated environment variable into a list of keys. The first key is the current key and
+// the rest are previous keys that are still accepted while rotating.
+func envKeys(name string) []string {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv(name), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func tokenSignature(key string, payload string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	_, _ = h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// NewToken creates a short lived token for user signed with the current token_key
+func NewToken(user User, now time.Time) (string, time.Time, error) {
+	keys := envKeys("token_key")
+	if len(keys) == 0 {
+		return "", time.Time{}, errors.New("no token key")
+	}
+	expiry := now.Add(time.Minute * tokenLifeMins)
+	payload, err := json.Marshal(tokenPayload{UUID: user.UUID, Expiry: expiry.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + tokenSignature(keys[0], encoded), expiry, nil
+}
+
+// ParseToken verifies a token against all the token keys and returns the user it was created for
+func ParseToken(token string, now time.Time) (User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return User{}, errors.New("invalid token")
+	}
+
+	valid := false
+	for _, key := range envKeys("token_key") {
+		if hmac.Equal([]byte(tokenSignature(key, parts[0])), []byte(parts[1])) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return User{}, errors.New("invalid token signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return User{}, err
+	}
+	var payload tokenPayload
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return User{}, err
+	}
+	if now.Unix() >= payload.Expiry {
+		return User{}, errors.New("expired token")
+	}
+	return User{UUID: payload.UUID}, nil
+}
+
+// IsValidServerKey checks key against all the server keys
+func IsValidServerKey(key string) bool {
+	for _, serverKey := range envKeys("server_key") {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(serverKey)) == 1 {
+			return true
+		}
+	}
+	return len(envKeys("server_key")) == 0 && key == ""
+}
+
+// Authenticate runs the Authenticators against r. The form must already have been parsed. A request from a device
+// that is not registered to the account is not authenticated.
+func (s *Server) Authenticate(r *http.Request) (Auth, bool) {
+	for _, authenticator := range Authenticators {
+		if user, ok := authenticator.Authenticate(s.db, r); ok {
+			user.DeviceID = r.Header.Get(deviceIDHeader)
+			if user.DeviceID != "" && !DeviceExists(s.db, user.UUID, user.DeviceID) {
+				return Auth{}, false
+			}
+			return Auth{User: user, Method: authenticator.Method()}, true
+		}
+	}
+	return Auth{}, false
+}
+
+// AuthHandler authenticates the request and stores the user in the request context for UserFromContext.
+// Requests that fail to authenticate are passed on without a user.
+func (s *Server) AuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// multipart bodies are left for the handler to stream
+		if err := r.ParseForm(); err != nil {
+			WriteError(w, r, ErrInvalidForm)
+			return
+		}
+		if auth, ok := s.Authenticate(r); ok {
+			r = r.WithContext(context.WithValue(r.Context(), authContextKey, auth))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthFromContext returns how the request was authenticated by AuthHandler
+func AuthFromContext(r *http.Request) (Auth, bool) {
+	auth, ok := r.Context().Value(authContextKey).(Auth)
+	return auth, ok
+}
+
+// UserFromContext returns the user authenticated by AuthHandler
+func UserFromContext(r *http.Request) (User, bool) {
+	auth, ok := AuthFromContext(r)
+	return auth.User, ok
+}
+
+// MultipartUser returns the user authenticated by AuthHandler or authenticates the request with the form values
+// of a multipart body which AuthHandler does not read
+func (s *Server) MultipartUser(r *http.Request) (User, bool) {
+	if user, ok := UserFromContext(r); ok {
+		return user, ok
+	}
+	auth, ok := s.Authenticate(r)
+	return auth.User, ok
+}
+
+// ChallengeResponse is a challenge to sign with the private key of the user
+type ChallengeResponse struct {
+	Challenge string    `json:"challenge"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// NewChallenge issues a single use challenge for the user to sign with their private key
+func (s *Server) NewChallenge(user User) (ChallengeResponse, error) {
+	if !IsValidUUID(user.UUID) {
+		return ChallengeResponse{}, ErrInvalidForm
+	}
+	if _, exists := user.GetUUIDKey(s.db); !exists {
+		return ChallengeResponse{}, ErrInvalidForm
+	}
+
+	b := make([]byte, challengeBytes)
+	if _, err := rand.Read(b); err != nil {
+		Handle(err)
+		return ChallengeResponse{}, ErrInternal.WithMessage("Failed to create challenge")
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	challenges.Set(challenge, Hash(user.UUID), cache.DefaultExpiration)
+	return ChallengeResponse{challenge, time.Now().Add(time.Minute * challengeLifeMins)}, nil
+}
+
+// ChallengeHandler issues a single use challenge for the user with UUID to sign with their private key. This allows
+// the user to authenticate without sending the UUID_key.
+func (s *Server) ChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	challenge, err := s.NewChallenge(User{UUID: r.Form.Get("UUID")})
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	Handle(WriteJSON(w, challenge))
+}
+
+// TokenResponse is a bearer token for the Authorization header
+type TokenResponse struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// TokenHandler creates a short lived bearer token that can be used instead of the UUID and UUID_key
+func (s *Server) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// tokens can not be used to extend themselves
+	auth, ok := AuthFromContext(r)
+	if !ok || auth.Method == authMethodToken {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	token, expiry, err := NewToken(auth.User, time.Now())
+	if err != nil {
+		Handle(err)
+		WriteError(w, r, ErrNotEnabled.WithMessage("Tokens are not enabled"))
+		return
+	}
+
+	Handle(WriteJSON(w, TokenResponse{token, expiry}))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	defer os.Setenv("token_key", os.Getenv("token_key"))
+	_ = os.Setenv("token_key", "old")
+
+	now := time.Now()
+	token, _, err := NewToken(User{UUID: "foo"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated keys should still accept tokens signed with the old key
+	_ = os.Setenv("token_key", "new, old")
+	if user, err := ParseToken(token, now); err != nil || user.UUID != "foo" {
+		t.Errorf("got %v %v", user, err)
+	}
+
+	if _, err := ParseToken(token, now.Add(time.Minute*tokenLifeMins)); err == nil {
+		t.Errorf("token should have expired")
+	}
+
+	_ = os.Setenv("token_key", "new")
+	if _, err := ParseToken(token, now); err == nil {
+		t.Errorf("token signed with a removed key should be invalid")
+	}
+
+	if _, err := ParseToken("not.a.token", now); err == nil {
+		t.Errorf("should be invalid token")
+	}
+}
+
+var serverKeys = []struct {
+	keys string
+	key  string
+	out  bool
+}{
+	{"", "", true},
+	{"", "foo", false},
+	{"foo", "", false},
+	{"foo", "foo", true},
+	{"bar,foo", "foo", true},
+	{"bar,foo", "baz", false},
+}
+
+func TestIsValidServerKey(t *testing.T) {
+	defer os.Setenv("server_key", os.Getenv("server_key"))
+	for _, tt := range serverKeys {
+		t.Run(tt.keys+":"+tt.key, func(t *testing.T) {
+			_ = os.Setenv("server_key", tt.keys)
+			if v := IsValidServerKey(tt.key); v != tt.out {
+				t.Errorf("got %v, wanted %v", v, tt.out)
+			}
+		})
+	}
+}
+
+func TestTokenHandler(t *testing.T) {
+	defer os.Setenv("token_key", os.Getenv("token_key"))
+	_ = os.Setenv("token_key", RandomString(32))
+
+	user, form := genUser()
+	form.Set("UUID_key", user.UUIDKey)
+	rr := postRequest(form, http.HandlerFunc(s.TokenHandler))
+	var token struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &token)
+	if rr.Code != 200 || token.Token == "" {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// authenticate with the token instead of the UUID and UUID_key
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token.Token)
+	tokenForm := url.Values{}
+	tokenForm.Set("filesize", "10")
+	tokenForm.Set("code", RandomString(codeLen))
+	rr = postRequestWithHeader(tokenForm, header, http.HandlerFunc(s.InitUploadHandler))
+	if rr.Code != 404 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+
+	// a token can't create another token
+	rr = postRequestWithHeader(tokenForm, header, http.HandlerFunc(s.TokenHandler))
+	if rr.Code != 401 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	header.Set("Authorization", "Bearer "+token.Token+"a")
+	rr = postRequestWithHeader(tokenForm, header, http.HandlerFunc(s.InitUploadHandler))
+	if rr.Code != 401 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+}
+
+func TestChallengeAuthentication(t *testing.T) {
+	privateKey, _, form := genKeyUser(t)
+	UUID := form.Get("UUID")
+	challenge := func() string { return getChallenge(t, UUID) }
+	sign := func(challenge string) string { return signChallenge(privateKey, challenge) }
+
+	// authenticate with a signed challenge instead of the UUID_key
+	header := http.Header{}
+	header.Set("UUID", UUID)
+	header.Set("Challenge", challenge())
+	header.Set("Signature", sign(header.Get("Challenge")))
+	uploadForm := url.Values{}
+	uploadForm.Set("filesize", "10")
+	uploadForm.Set("code", RandomString(codeLen))
+	rr := postRequestWithHeader(uploadForm, header, http.HandlerFunc(s.InitUploadHandler))
+	if rr.Code != 404 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+
+	// challenges can only be used once
+	rr = postRequestWithHeader(uploadForm, header, http.HandlerFunc(s.InitUploadHandler))
+	if rr.Code != 401 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	// signature of a different challenge
+	header.Set("Challenge", challenge())
+	rr = postRequestWithHeader(uploadForm, header, http.HandlerFunc(s.InitUploadHandler))
+	if rr.Code != 401 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	// an invalid signature doesn't use up the challenge
+	header.Set("Signature", sign(header.Get("Challenge")))
+	rr = postRequestWithHeader(uploadForm, header, http.HandlerFunc(s.InitUploadHandler))
+	if rr.Code != 404 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+
+	// a challenge used by requests at the same time only authenticates one of them
+	header.Set("Challenge", challenge())
+	header.Set("Signature", sign(header.Get("Challenge")))
+	var wg sync.WaitGroup
+	var authenticated int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rr := postRequestWithHeader(uploadForm, header, http.HandlerFunc(s.InitUploadHandler)); rr.Code != 401 {
+				atomic.AddInt32(&authenticated, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if authenticated != 1 {
+		t.Errorf("Got %v authenticated requests expected %v", authenticated, 1)
+	}
+
+	// challenge issued to another user
+	_, otherForm := genUser()
+	header.Set("Challenge", challenge())
+	header.Set("Signature", sign(header.Get("Challenge")))
+	header.Set("UUID", otherForm.Get("UUID"))
+	rr = postRequestWithHeader(uploadForm, header, http.HandlerFunc(s.InitUploadHandler))
+	if rr.Code != 401 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	// connect to the socket with a signed challenge
+	header.Set("UUID", UUID)
+	header.Set("Challenge", challenge())
+	header.Set("Signature", sign(header.Get("Challenge")))
+	header.Set("Version", "1.0")
+	server, res, ws, err := connectWSSHeader(header)
+	if err != nil {
+		t.Fatalf("Got %v expected %v", res.StatusCode, 101)
+	}
+	ws.Close()
+	server.Close()
+
+	// no challenges for users that don't exist
+	rr = postRequest(url.Values{"UUID": {uuid.New().String()}}, http.HandlerFunc(s.ChallengeHandler))
+	if rr.Code != 400 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+
+	// a form that can't be parsed
+	req, _ := http.NewRequest("POST", "", strings.NewReader("UUID=%zz"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.ChallengeHandler).ServeHTTP(rr, req)
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrInvalidForm.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+}
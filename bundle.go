@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const maxBundleFiles = 1000
+
+var validFileHashRegex = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// TransferFile is a single file of a multi file transfer (a bundle) described by the manifest passed to
+// InitUploadHandler
+type TransferFile struct {
+	Path     string `json:"path"`
+	Size     int    `json:"size"`
+	Hash     string `json:"hash"`
+	filePath string
+	uploaded bool
+}
+
+// ParseManifest parses and validates a JSON list of TransferFile
+func ParseManifest(manifest string) ([]TransferFile, error) {
+	var files []TransferFile
+	if err := json.Unmarshal([]byte(manifest), &files); err != nil {
+		return nil, errors.New("invalid manifest")
+	}
+	return files, ValidateManifest(files)
+}
+
+// ValidateManifest checks the paths, sizes and hashes of all files in a manifest
+func ValidateManifest(files []TransferFile) error {
+	if len(files) == 0 || len(files) > maxBundleFiles {
+		return errors.New("invalid number of files in manifest")
+	}
+
+	paths := make(map[string]bool)
+	for _, file := range files {
+		if !IsValidRelativePath(file.Path) || paths[file.Path] {
+			return errors.New("invalid path in manifest: " + file.Path)
+		}
+		paths[file.Path] = true
+		if file.Size < 0 || !validFileHashRegex.MatchString(file.Hash) {
+			return errors.New("invalid file in manifest: " + file.Path)
+		}
+	}
+	return nil
+}
+
+// ManifestSize is the total size of all files
+func ManifestSize(files []TransferFile) (size int) {
+	for _, file := range files {
+		size += file.Size
+	}
+	return
+}
+
+// ManifestHash is the hash of a bundle. It is the sha256 of the hex hashes of every file in manifest order.
+func ManifestHash(files []TransferFile) string {
+	hasher := sha256.New()
+	for _, file := range files {
+		_, _ = hasher.Write([]byte(file.Hash))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// IsBundle returns true if the transfer is made up of multiple files
+func (transfer Transfer) IsBundle() bool {
+	return strings.HasSuffix(transfer.FilePath, "/")
+}
+
+// StoreFiles stores the manifest of a transfer along with where each file will be kept in fileStorage
+func (transfer Transfer) StoreFiles(db *sql.DB, files []TransferFile) error {
+	dir := RandomString(userDirLen)
+	for _, file := range files {
+		_, err := db.Exec(`
+		INSERT INTO transfer_file (transfer_id, path, file_path, size, file_hash)
+		VALUES (?, ?, ?, ?, ?)`, transfer.ID, file.Path, dir+"/"+file.Path, file.Size, file.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFiles fetches the manifest of a transfer. A transfer that is not a bundle will have no files. The manifest of a
+// group is stored against the first transfer of the group.
+func (transfer *Transfer) GetFiles(db *sql.DB) error {
+	manifestID := transfer.ID
+	if transfer.groupID > 0 {
+		manifestID = transfer.groupID
+	}
+	rows, err := db.Query(`
+	SELECT path, file_path, size, file_hash, uploaded
+	FROM transfer_file
+	WHERE transfer_id = ?
+	ORDER BY id`, manifestID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	transfer.Files = nil
+	for rows.Next() {
+		var file TransferFile
+		if err := rows.Scan(&file.Path, &file.filePath, &file.Size, &file.Hash, &file.uploaded); err != nil {
+			return err
+		}
+		transfer.Files = append(transfer.Files, file)
+	}
+	return rows.Err()
+}
+
+// GetFile returns the file at the relative path p of a bundle
+func (transfer Transfer) GetFile(p string) (TransferFile, bool) {
+	for _, file := range transfer.Files {
+		if file.Path == p {
+			return file, true
+		}
+	}
+	return TransferFile{}, false
+}
+
+// FileUploaded marks a file of a bundle as uploaded
+func (transfer Transfer) FileUploaded(db *sql.DB, file TransferFile) error {
+	return UpdateErr(db.Exec(`
+	UPDATE transfer_file
+	SET uploaded = 1
+	WHERE transfer_id = ?
+	AND path = ?`, transfer.ID, file.Path))
+}
+
+// BundleDir returns the directory in fileStorage that holds every file of the bundle
+func (transfer Transfer) BundleDir() string {
+	if len(transfer.Files) == 0 {
+		return ""
+	}
+	file := transfer.Files[0]
+	return strings.TrimSuffix(file.filePath, file.Path)
+}
+
+// WriteTar streams every file of a bundle to w as a tar archive
+func (transfer Transfer) WriteTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, file := range transfer.Files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    file.Path,
+			Mode:    0644,
+			Size:    int64(file.Size),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		r, err := fileStorage.Get(file.filePath, 0, -1)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// BusMessage is a socket message published to every instance of the backend. Each instance delivers it to the
+// sockets of the user that it holds.
+type BusMessage struct {
+	ID string `json:"id"`
+	// hashed UUID of the user
+	UUID    string        `json:"uuid"`
+	Message SocketMessage `json:"message"`
+	// deliver to every device of the user except Device
+	Except bool   `json:"except,omitempty"`
+	Device string `json:"device,omitempty"`
+	// close the socket of Device instead of delivering a message
+	Disconnect bool `json:"disconnect,omitempty"`
+}
+
+// Bus connects the instances of the backend so that a message for a user reaches their sockets whichever instance
+// they are connected to
+type Bus interface {
+	// Publish sends msg to every subscribed instance including this one. It returns true if any instance
+	// delivered it to a socket.
+	Publish(msg BusMessage) (bool, error)
+	// Subscribe registers deliver to be called with every published message. deliver returns true if it delivered
+	// the message to a socket.
+	Subscribe(deliver func(BusMessage) bool) error
+	Close() error
+}
+
+// NewBus creates the Bus chosen with the bus environment variable
+func NewBus() Bus {
+	if os.Getenv("bus") == "redis" {
+		return NewRedisBus(os.Getenv("redis_addr"), os.Getenv("redis_password"))
+	}
+	return NewLocalBus()
+}
+
+// LocalBus delivers messages within a single process
+type LocalBus struct {
+	subscribers []func(BusMessage) bool
+	sync.RWMutex
+}
+
+// NewLocalBus creates a LocalBus with no subscribers
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+// Publish delivers msg to every subscriber before returning
+func (b *LocalBus) Publish(msg BusMessage) (bool, error) {
+	b.RLock()
+	subscribers := b.subscribers
+	b.RUnlock()
+
+	delivered := false
+	for _, deliver := range subscribers {
+		if deliver(msg) {
+			delivered = true
+		}
+	}
+	return delivered, nil
+}
+
+// Subscribe adds deliver to the subscribers
+func (b *LocalBus) Subscribe(deliver func(BusMessage) bool) error {
+	b.Lock()
+	b.subscribers = append(b.subscribers, deliver)
+	b.Unlock()
+	return nil
+}
+
+// Close removes all subscribers
+func (b *LocalBus) Close() error {
+	b.Lock()
+	b.subscribers = nil
+	b.Unlock()
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-redis/redis"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	redisChannel      = "transfermeit:ws"
+	redisReplyChannel = "transfermeit:ws:reply:"
+	redisDialSecs     = 5
+	// how long Publish waits for the other instances to say whether they delivered a message
+	redisReplyTimeoutMs = 500
+	// replies that can be buffered for a message before they are dropped
+	redisMaxReplies = 64
+	// messages are delivered by redisDeliverers workers so that a slow socket can't hold up the subscription. The
+	// messages of a user are always delivered by the same worker so that they stay in order.
+	redisDeliverers      = 16
+	redisDeliverQueueLen = 256
+)
+
+// RedisBus publishes messages over Redis pub/sub. Every instance subscribes to redisChannel and to a reply channel of
+// its own which the other instances use to tell it whether they delivered its message.
+type RedisBus struct {
+	Addr     string
+	Password string
+	instance string
+
+	client  *redis.Client
+	sub     *redis.PubSub
+	deliver func(BusMessage) bool
+	queues  []chan busEnvelope
+	closed  chan struct{}
+	// replies waiting for by message ID
+	waiters map[string]chan busReply
+	sync.Mutex
+}
+
+// busEnvelope is a message as published to redisChannel
+type busEnvelope struct {
+	Reply   string     `json:"reply"`
+	Message BusMessage `json:"msg"`
+}
+
+type busReply struct {
+	ID        string `json:"id"`
+	Delivered bool   `json:"delivered"`
+}
+
+// NewRedisBus creates a RedisBus for the Redis server at addr
+func NewRedisBus(addr, password string) *RedisBus {
+	return &RedisBus{
+		Addr:     addr,
+		Password: password,
+		instance: RandomString(20),
+		client: redis.NewClient(&redis.Options{
+			Addr:        addr,
+			Password:    password,
+			DialTimeout: time.Second * redisDialSecs,
+		}),
+		closed:  make(chan struct{}),
+		waiters: make(map[string]chan busReply),
+	}
+}
+
+func (b *RedisBus) replyChannel() string {
+	return redisReplyChannel + b.instance
+}
+
+// Publish publishes msg and waits for every instance that received it to reply or for redisReplyTimeoutMs
+func (b *RedisBus) Publish(msg BusMessage) (bool, error) {
+	payload, err := json.Marshal(busEnvelope{Reply: b.replyChannel(), Message: msg})
+	if err != nil {
+		return false, err
+	}
+
+	replies := make(chan busReply, redisMaxReplies)
+	b.Lock()
+	b.waiters[msg.ID] = replies
+	b.Unlock()
+	defer func() {
+		b.Lock()
+		delete(b.waiters, msg.ID)
+		b.Unlock()
+	}()
+
+	receivers, err := b.client.Publish(redisChannel, payload).Result()
+	if err != nil {
+		return false, err
+	}
+
+	timeout := time.After(time.Millisecond * redisReplyTimeoutMs)
+	for i := int64(0); i < receivers; i++ {
+		select {
+		case r := <-replies:
+			if r.Delivered {
+				return true, nil
+			}
+		case <-timeout:
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
+// Subscribe subscribes to the published messages and the replies to this instance and then reads them in the
+// background until Close. The client reconnects and resubscribes whenever the connection is lost.
+func (b *RedisBus) Subscribe(deliver func(BusMessage) bool) error {
+	sub := b.client.Subscribe(redisChannel, b.replyChannel())
+	// wait for the subscription to be confirmed
+	if _, err := sub.Receive(); err != nil {
+		_ = sub.Close()
+		return err
+	}
+
+	b.Lock()
+	b.sub = sub
+	b.deliver = deliver
+	b.queues = make([]chan busEnvelope, redisDeliverers)
+	for i := range b.queues {
+		b.queues[i] = make(chan busEnvelope, redisDeliverQueueLen)
+		go b.deliverQueue(b.queues[i])
+	}
+	b.Unlock()
+
+	go b.readSub(sub.Channel())
+	return nil
+}
+
+func (b *RedisBus) readSub(messages <-chan *redis.Message) {
+	for message := range messages {
+		if message.Channel == redisChannel {
+			b.handleMessage([]byte(message.Payload))
+		} else {
+			b.handleReply([]byte(message.Payload))
+		}
+	}
+}
+
+// handleMessage queues a published message to be delivered by the worker of its user
+func (b *RedisBus) handleMessage(payload []byte) {
+	var envelope busEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		Handle(err)
+		return
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(envelope.Message.UUID))
+
+	b.Lock()
+	queue := b.queues[h.Sum32()%uint32(len(b.queues))]
+	b.Unlock()
+	select {
+	case queue <- envelope:
+	case <-b.closed:
+	}
+}
+
+// deliverQueue delivers the messages of queue and tells each publisher whether its message was delivered
+func (b *RedisBus) deliverQueue(queue chan busEnvelope) {
+	for {
+		select {
+		case envelope := <-queue:
+			b.Lock()
+			deliver := b.deliver
+			b.Unlock()
+
+			reply, err := json.Marshal(busReply{ID: envelope.Message.ID, Delivered: deliver(envelope.Message)})
+			if err != nil {
+				Handle(err)
+				continue
+			}
+			Handle(b.client.Publish(envelope.Reply, reply).Err())
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+func (b *RedisBus) handleReply(payload []byte) {
+	var reply busReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		Handle(err)
+		return
+	}
+	b.Lock()
+	replies, ok := b.waiters[reply.ID]
+	b.Unlock()
+	if ok {
+		// never block the subscription on a publisher that has stopped waiting
+		select {
+		case replies <- reply:
+		default:
+		}
+	}
+}
+
+// Close stops the subscription and closes the connections
+func (b *RedisBus) Close() error {
+	close(b.closed)
+	b.Lock()
+	sub := b.sub
+	b.Unlock()
+	if sub != nil {
+		Handle(sub.Close())
+	}
+	return b.client.Close()
+}
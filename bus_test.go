@@ -0,0 +1,180 @@
+package main
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newRedisServer(t *testing.T, password string) *miniredis.Miniredis {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "" {
+		server.RequireAuth(password)
+	}
+	return server
+}
+
+func TestRedisBus(t *testing.T) {
+	server := newRedisServer(t, "secret")
+	defer server.Close()
+
+	if err := NewRedisBus(server.Addr(), "wrong").Subscribe(func(BusMessage) bool {
+		return true
+	}); err == nil {
+		t.Errorf("expected invalid password to fail")
+	}
+
+	received := make(chan BusMessage, 10)
+	busA := NewRedisBus(server.Addr(), "secret")
+	defer busA.Close()
+	busB := NewRedisBus(server.Addr(), "secret")
+	defer busB.Close()
+	if err := busA.Subscribe(func(BusMessage) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	var deliverB int32 = 1
+	if err := busB.Subscribe(func(msg BusMessage) bool {
+		received <- msg
+		return atomic.LoadInt32(&deliverB) == 1
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a message published by one instance is delivered by another
+	msg := BusMessage{ID: "1", UUID: "foo", Message: SocketMessage{Message: &DesktopMessage{Title: "bar"}}}
+	if delivered, err := busA.Publish(msg); err != nil || !delivered {
+		t.Errorf("got %v %v", delivered, err)
+	}
+	if got := <-received; got.ID != "1" || got.Message.Message.Title != "bar" {
+		t.Errorf("got %+v", got)
+	}
+
+	// publishing returns as soon as every instance has replied when none of them has the socket
+	atomic.StoreInt32(&deliverB, 0)
+	start := time.Now()
+	if delivered, err := busA.Publish(BusMessage{ID: "2", UUID: "foo"}); err != nil || delivered {
+		t.Errorf("got %v %v", delivered, err)
+	}
+	if time.Since(start) >= time.Millisecond*redisReplyTimeoutMs {
+		t.Errorf("waited for the reply timeout")
+	}
+	<-received
+	atomic.StoreInt32(&deliverB, 1)
+
+	// the subscription is restored after the connection to redis is lost
+	server.Close()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	var delivered bool
+	var err error
+	for i := 0; i < 20 && !delivered; i++ {
+		time.Sleep(time.Millisecond * 100)
+		delivered, err = busA.Publish(BusMessage{ID: "3", UUID: "foo"})
+	}
+	if err != nil || !delivered {
+		t.Errorf("got %v %v", delivered, err)
+	}
+}
+
+func TestRedisBusSlowDelivery(t *testing.T) {
+	server := newRedisServer(t, "")
+	defer server.Close()
+
+	busA := NewRedisBus(server.Addr(), "")
+	defer busA.Close()
+	busB := NewRedisBus(server.Addr(), "")
+	defer busB.Close()
+	if err := busA.Subscribe(func(BusMessage) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	unblock := make(chan struct{})
+	defer close(unblock)
+	if err := busB.Subscribe(func(msg BusMessage) bool {
+		if msg.UUID == "slow" {
+			<-unblock
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a socket that is slow to write to doesn't hold up the messages of other users
+	go func() { _, _ = busA.Publish(BusMessage{ID: "1", UUID: "slow"}) }()
+	time.Sleep(time.Millisecond * 50)
+	if delivered, err := busA.Publish(BusMessage{ID: "2", UUID: "fast"}); err != nil || !delivered {
+		t.Errorf("got %v %v", delivered, err)
+	}
+}
+
+// TestRedisBusServer runs against the real Redis server at redis_addr when it is set
+func TestRedisBusServer(t *testing.T) {
+	addr := os.Getenv("redis_addr")
+	if addr == "" {
+		t.Skip("redis_addr not set")
+	}
+	busA := NewRedisBus(addr, os.Getenv("redis_password"))
+	defer busA.Close()
+	busB := NewRedisBus(addr, os.Getenv("redis_password"))
+	defer busB.Close()
+	if err := busA.Subscribe(func(BusMessage) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if err := busB.Subscribe(func(msg BusMessage) bool { return msg.UUID == "foo" }); err != nil {
+		t.Fatal(err)
+	}
+
+	if delivered, err := busA.Publish(BusMessage{ID: RandomString(10), UUID: "foo"}); err != nil || !delivered {
+		t.Errorf("got %v %v", delivered, err)
+	}
+	if delivered, err := busA.Publish(BusMessage{ID: RandomString(10), UUID: "bar"}); err != nil || delivered {
+		t.Errorf("got %v %v", delivered, err)
+	}
+}
+
+func TestRedisBusSockets(t *testing.T) {
+	server := newRedisServer(t, "")
+	defer server.Close()
+
+	// WSConns holds the socket of the user and other is another instance of the backend
+	if err := WSConns.SetBus(NewRedisBus(server.Addr(), "")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Handle(WSConns.SetBus(NewLocalBus())) }()
+	other := NewFunnels()
+	if err := other.SetBus(NewRedisBus(server.Addr(), "")); err != nil {
+		t.Fatal(err)
+	}
+	defer other.bus.Close()
+
+	user, form := genUser()
+	wsheader := http.Header{}
+	wsheader.Set("UUID", form.Get("UUID"))
+	wsheader.Set("UUID-key", user.UUIDKey)
+	wsheader.Set("Version", "2.0")
+	_, _, ws, _ := connectWSSHeader(wsheader)
+	defer ws.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	if !other.Write(s.db, SocketMessage{Message: &DesktopMessage{Title: "foo"}}, form.Get("UUID"), true) {
+		t.Errorf("expected the message to be delivered by the other instance")
+	}
+	if frame := readSocketFrame(t, ws); frame.Type != socketTypeMessage {
+		t.Errorf("got %+v", frame)
+	}
+
+	// a user connected to neither instance gets the message when they next connect
+	_, form2 := genUser()
+	if other.Write(s.db, SocketMessage{Message: &DesktopMessage{Title: "foo"}}, form2.Get("UUID"), true) {
+		t.Errorf("expected the message not to be delivered")
+	}
+	if messages, _ := PopPendingMessages(s.db, Hash(form2.Get("UUID")), ""); len(messages) != 1 {
+		t.Errorf("got %+v", messages)
+	}
+}
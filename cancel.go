@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// cancelReasonCancelled is sent to the other user of a transfer that was cancelled
+const cancelReasonCancelled = "cancelled"
+
+// CancelRequest cancels a transfer. The sender cancels the transfer returned by InitUpload for every friend or only
+// for the friend with Code. The friend cancels the transfer they were offered.
+type CancelRequest struct {
+	TransferID int64  `json:"transfer_id"`
+	Code       string `json:"code,omitempty"`
+}
+
+// GetCancellableTransfers fetches the unfinished transfers that user can cancel with req. fromSender is true if user
+// is the sender of the transfers.
+func GetCancellableTransfers(db *sql.DB, user User, req CancelRequest) (transfers []Transfer, fromSender bool,
+	err error) {
+	scan := func(rows *sql.Rows, err error) ([]Transfer, error) {
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var transfers []Transfer
+		for rows.Next() {
+			var (
+				transfer Transfer
+				filePath sql.NullString
+			)
+			if err := rows.Scan(&transfer.ID, &transfer.groupID, &transfer.from.UUID, &transfer.to.UUID,
+				&transfer.to.Code, &filePath); err != nil {
+				return nil, err
+			}
+			transfer.FilePath = filePath.String
+			transfers = append(transfers, transfer)
+		}
+		return transfers, rows.Err()
+	}
+
+	// the sender
+	transfers, err = scan(db.Query(`
+	SELECT id, IFNULL(group_id, id), from_UUID, to_UUID, IFNULL(to_code, ''), file_path
+	FROM transfer
+	WHERE (id = ? OR group_id = ?)
+	AND from_UUID = ?
+	AND (? = '' OR to_code = ?)
+	AND finished_dttm IS NULL
+	ORDER BY id`, req.TransferID, req.TransferID, Hash(user.UUID), req.Code, req.Code))
+	if err != nil || len(transfers) > 0 {
+		return transfers, true, err
+	}
+
+	// the friend
+	transfers, err = scan(db.Query(`
+	SELECT id, IFNULL(group_id, id), from_UUID, to_UUID, IFNULL(to_code, ''), file_path
+	FROM transfer
+	WHERE id = ?
+	AND to_UUID = ?
+	AND finished_dttm IS NULL`, req.TransferID, Hash(user.UUID)))
+	return transfers, false, err
+}
+
+// Cancelled moves the transfer to cancelled because of reason, withdraws any offer waiting for the friend and deletes
+// the file once no other friend in the group needs it. changed is false if the transfer was already cancelled.
+func (transfer Transfer) Cancelled(db *sql.DB, reason string) (changed bool, err error) {
+	changed, err = transfer.Transition(db, StateCancelled, reason, func(tx *sql.Tx) error {
+		return UpdateErr(tx.Exec(`
+		UPDATE transfer
+		SET file_path = NULL, finished_dttm = NOW(), password = NULL, failed = 1
+		WHERE id = ?`, transfer.ID))
+	})
+	if err != nil || !changed {
+		return changed, err
+	}
+
+	Handle(DeletePendingMessage(db, transfer.to.UUID, SocketMessage{Download: &transfer}.DedupKey()))
+	Handle(DeletePendingMessage(db, transfer.to.UUID,
+		SocketMessage{Offer: &TransferOffer{TransferID: transfer.ID}}.DedupKey()))
+
+	if transfer.FilePath != "" && !fileInUse(db, transfer.FilePath) {
+		deleteUploadDir(transfer.FilePath)
+	}
+	return true, nil
+}
+
+// CancelTransfer cancels the transfers of user matching req and tells the other user of each transfer
+func (s *Server) CancelTransfer(user User, req CancelRequest) error {
+	transfers, fromSender, err := GetCancellableTransfers(s.db, user, req)
+	if err != nil {
+		Handle(err)
+		return ErrInternal.WithMessage("Failed to fetch transfer")
+	}
+	if len(transfers) == 0 {
+		return ErrTransferNotFound
+	}
+
+	reason := "cancelled by the friend"
+	if fromSender {
+		reason = "cancelled by the sender"
+	}
+	cancelled := 0
+	for _, transfer := range transfers {
+		changed, err := transfer.Cancelled(s.db, reason)
+		if err != nil {
+			if e, ok := err.(APIError); ok {
+				return e
+			}
+			Handle(err)
+			return ErrInternal.WithMessage("Failed to cancel transfer")
+		} else if !changed {
+			// cancelled at the same time by the other user
+			continue
+		}
+		cancelled++
+
+		if fromSender {
+			WSConns.Write(s.db, SocketMessage{Cancel: &Cancel{
+				TransferID: transfer.ID,
+				FilePath:   transfer.FilePath,
+				Reason:     cancelReasonCancelled,
+			}}, transfer.to.UUID, false)
+			WSConns.Write(s.db, SocketMessage{Message: &DesktopMessage{
+				Title:   "Cancelled Transfer",
+				Message: "Your friend cancelled the transfer!",
+			}}, transfer.to.UUID, false)
+		} else {
+			WSConns.Write(s.db, SocketMessage{Cancel: &Cancel{
+				TransferID: transfer.groupID,
+				Code:       transfer.to.Code,
+				FilePath:   transfer.FilePath,
+				Reason:     cancelReasonCancelled,
+			}}, transfer.from.UUID, true)
+			transfer.notifySender(s.db, true, false)
+		}
+	}
+
+	if cancelled == 0 {
+		return ErrTransferNotFound
+	}
+
+	// chunks of a file that is still being uploaded are kept while any friend of the group is waiting for it
+	groupID := transfers[0].groupID
+	group, err := Transfer{ID: groupID}.GetGroup(s.db)
+	if err != nil {
+		Handle(err)
+	} else if len(group) == 0 {
+		Handle(DeletePrefix(fileStorage, chunkDir(groupID)))
+	}
+	return nil
+}
+
+// CancelHandler is the form handler for CancelTransfer
+func (s *Server) CancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	transferID, _ := strconv.ParseInt(r.Form.Get("transfer_id"), 10, 64)
+	if err := s.CancelTransfer(user, CancelRequest{TransferID: transferID, Code: r.Form.Get("code")}); err != nil {
+		WriteError(w, r, AsAPIError(err))
+	}
+}
+
+// V1CancelHandler is the JSON handler for CancelTransfer
+func (s *Server) V1CancelHandler(w http.ResponseWriter, r *http.Request) {
+	var req CancelRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	writeJSONResult(w, r, nil, s.CancelTransfer(user, req))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// sendV1 uploads fileBytes from user1 with req returning the transfer of user1
+func sendV1(t *testing.T, user1 User, header1 http.Header, req InitUploadRequest,
+	fileBytes []byte) InitUploadResponse {
+	req.Filesize = len(fileBytes)
+	rr := postJSON(req, header1, http.HandlerFunc(s.V1InitUploadHandler))
+	var initUpload InitUploadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &initUpload); rr.Code != 200 || err != nil {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	credentials := url.Values{"UUID": {user1.UUID}, "UUID_key": {user1.UUIDKey}}
+	transferID := strconv.FormatInt(initUpload.TransferID, 10)
+	if rr = uploadChunk(credentials, transferID, 0, fileBytes); rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	rr = postJSON(CompleteUploadRequest{
+		TransferID: initUpload.TransferID,
+		Filename:   "foo.bar",
+		Passwords:  map[string]string{"password": "foo"},
+	}, header1, http.HandlerFunc(s.V1UploadCompleteHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+	return initUpload
+}
+
+func TestSenderCancel(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	recipientWs := connectDeviceWSS(header2)
+	defer recipientWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	initUpload := sendV1(t, user1, header1, InitUploadRequest{Codes: []string{user2.Code}},
+		[]byte(RandomString(100)))
+	var offer Transfer
+	readSocketFrameType(t, recipientWs, socketTypeDownloadOffer, &offer)
+	if offer.ID == 0 {
+		t.Fatalf("got %+v", offer)
+	}
+
+	rr := postJSON(CancelRequest{TransferID: initUpload.TransferID}, header1, http.HandlerFunc(s.V1CancelHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+	var cancel Cancel
+	readSocketFrameType(t, recipientWs, socketTypeCancel, &cancel)
+	if cancel.TransferID != offer.ID || cancel.FilePath != offer.FilePath || cancel.Reason != cancelReasonCancelled {
+		t.Errorf("got %+v", cancel)
+	}
+
+	// the file is deleted and can no longer be downloaded
+	if _, err := fileStorage.Stat(offer.FilePath); !os.IsNotExist(err) {
+		t.Errorf("expected the file to be deleted got %v", err)
+	}
+	rr = postRequestWithHeader(url.Values{"file_path": {offer.FilePath}}, header2, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 404 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+	rr = postJSON(CancelRequest{TransferID: initUpload.TransferID}, header1, http.HandlerFunc(s.V1CancelHandler))
+	if e := readError(rr); rr.Code != 404 || e.Code != ErrTransferNotFound.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+
+	// a cancel racing the one above does nothing
+	if changed, err := offer.Cancelled(s.db, "foo"); changed || err != nil {
+		t.Errorf("got %v %v expected the transfer to already be cancelled", changed, err)
+	}
+}
+
+func TestRecipientCancel(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	senderWs := connectDeviceWSS(header1)
+	defer senderWs.Close()
+	recipientWs := connectDeviceWSS(header2)
+	defer recipientWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	initUpload := sendV1(t, user1, header1, InitUploadRequest{Codes: []string{user2.Code}},
+		[]byte(RandomString(100)))
+	var offer Transfer
+	readSocketFrameType(t, recipientWs, socketTypeDownloadOffer, &offer)
+
+	// the friend can only cancel their own transfers
+	_, header3 := v1User(t)
+	strangerWs := connectDeviceWSS(header3)
+	defer strangerWs.Close()
+	for _, ws := range []*websocket.Conn{strangerWs, recipientWs} {
+		payload, _ := json.Marshal(CancelRequest{TransferID: offer.ID})
+		writeSocketFrame(t, ws, SocketFrame{ID: 1, Type: socketTypeCancel, Payload: payload})
+	}
+	var e APIError
+	readSocketFrameType(t, strangerWs, socketTypeError, &e)
+	if e.Code != ErrTransferNotFound.Code {
+		t.Errorf("got %+v", e)
+	}
+
+	var cancel Cancel
+	readSocketFrameType(t, senderWs, socketTypeCancel, &cancel)
+	if cancel.TransferID != initUpload.TransferID || cancel.Code != user2.Code || cancel.FilePath != offer.FilePath {
+		t.Errorf("got %+v", cancel)
+	}
+	var message DesktopMessage
+	readSocketFrameType(t, senderWs, socketTypeMessage, &message)
+	if message.Title != "Cancelled Transfer" {
+		t.Errorf("got %+v", message)
+	}
+	if _, err := fileStorage.Stat(offer.FilePath); !os.IsNotExist(err) {
+		t.Errorf("expected the file to be deleted got %v", err)
+	}
+}
+
+func TestCancelBeforeUpload(t *testing.T) {
+	user1, form1 := genUser()
+	user2, _ := genUser()
+	f, _ := os.Create("foo.bar")
+	defer f.Close()
+	defer os.Remove("foo.bar")
+	_, _ = f.WriteString(RandomString(10))
+	_, _ = f.Seek(0, 0)
+
+	initUploadR := initUpload(form1, user1, user2, 10)
+	transferID, _ := strconv.ParseInt(initUploadR.Header().Get("Transfer-ID"), 10, 64)
+	if initUploadR.Code != 200 || transferID == 0 {
+		t.Fatalf("Got %v (%v) expected %v", initUploadR.Code, initUploadR.Body, 200)
+	}
+	if err := s.CancelTransfer(User{UUID: form1.Get("UUID")}, CancelRequest{TransferID: transferID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file of a cancelled transfer is not stored
+	rr := uploadFile(f, initUploadR.Header().Get("Set-Cookie"), "foo")
+	if e := readError(rr); rr.Code != 404 || e.Code != ErrTransferNotFound.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+
+	// nor marked as uploaded if it was cancelled while it was being uploaded
+	if err := (Transfer{ID: transferID}).Uploading(s.db); err != ErrTransferNotFound {
+		t.Errorf("got %v expected %v", err, ErrTransferNotFound)
+	}
+	if err := (Transfer{ID: transferID}).Uploaded(s.db); err != ErrTransferNotFound {
+		t.Errorf("got %v expected %v", err, ErrTransferNotFound)
+	}
+}
+
+func TestGroupCancelDuringUpload(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	user3, header3 := v1User(t)
+	recipientWs := connectDeviceWSS(header3)
+	defer recipientWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	fileBytes := []byte(RandomString(100))
+	rr := postJSON(InitUploadRequest{Filesize: len(fileBytes), Codes: []string{user2.Code, user3.Code}}, header1,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var initUpload InitUploadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &initUpload); rr.Code != 200 || err != nil {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	credentials := url.Values{"UUID": {user1.UUID}, "UUID_key": {user1.UUIDKey}}
+	transferID := strconv.FormatInt(initUpload.TransferID, 10)
+	if rr = uploadChunk(credentials, transferID, 0, fileBytes[:60]); rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// the sender cancelling one friend keeps the chunks the other friend is waiting on
+	rr = postJSON(CancelRequest{TransferID: initUpload.TransferID, Code: user2.Code}, header1,
+		http.HandlerFunc(s.V1CancelHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+	if rr = uploadChunk(credentials, transferID, 60, fileBytes[60:]); rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	rr = postJSON(CompleteUploadRequest{
+		TransferID: initUpload.TransferID,
+		Filename:   "foo.bar",
+		Passwords:  map[string]string{"password": "foo"},
+	}, header1, http.HandlerFunc(s.V1UploadCompleteHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+
+	var offer Transfer
+	readSocketFrameType(t, recipientWs, socketTypeDownloadOffer, &offer)
+	rr = postRequestWithHeader(url.Values{"file_path": {offer.FilePath}}, header3, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 200 || rr.Body.String() != string(fileBytes) {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// the cancelled friend is not offered the file
+	rr = postRequestWithHeader(url.Values{"file_path": {offer.FilePath}}, header2, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code == 200 {
+		t.Errorf("Got %v (%v) expected the cancelled friend not to be able to download", rr.Code, rr.Body)
+	}
+
+	// once no friend is waiting the chunks are deleted
+	initUpload = InitUploadResponse{}
+	rr = postJSON(InitUploadRequest{Filesize: len(fileBytes), Codes: []string{user2.Code}}, header1,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	_ = json.Unmarshal(rr.Body.Bytes(), &initUpload)
+	transferID = strconv.FormatInt(initUpload.TransferID, 10)
+	uploadChunk(credentials, transferID, 0, fileBytes[:60])
+	rr = postJSON(CancelRequest{TransferID: initUpload.TransferID}, header1, http.HandlerFunc(s.V1CancelHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+	if chunks, err := ReceivedChunks(initUpload.TransferID); err != nil || len(chunks) != 0 {
+		t.Errorf("got %v %v expected the chunks to be deleted", chunks, err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	chunkDirName    = ".chunks"
+	maxChunkBytes   = 50 << 20
+	staleChunkHours = 24
+)
+
+// Chunk describes a part of a file that has been received by the server
+type Chunk struct {
+	Offset int `json:"offset"`
+	Size   int `json:"size"`
+}
+
+func chunkDir(transferID int64) string {
+	return chunkDirName + "/" + strconv.FormatInt(transferID, 10) + "/"
+}
+
+func chunkKey(transferID int64, offset int) string {
+	return chunkDir(transferID) + strconv.Itoa(offset)
+}
+
+// ReceivedChunks returns all the chunks that have been stored for a transfer ordered by offset
+func ReceivedChunks(transferID int64) ([]Chunk, error) {
+	chunks := []Chunk{}
+	objects, err := fileStorage.List(chunkDir(transferID))
+	if err != nil {
+		return chunks, err
+	}
+
+	for _, object := range objects {
+		offset, err := strconv.Atoi(path.Base(object.Key))
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, Chunk{Offset: offset, Size: int(object.Size)})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Offset < chunks[j].Offset })
+	return chunks, nil
+}
+
+// StoreChunk writes a chunk of a transfer at offset. The chunk is only visible to ReceivedChunks once it has been
+// completely written so a dropped connection will never leave a partial chunk behind. Any chunks that the new chunk
+// overlaps are replaced by it so a client can resend part of a file with a different chunk size.
+func StoreChunk(transferID int64, offset int, r io.Reader) (int, error) {
+	n, err := fileStorage.Put(chunkKey(transferID, offset), io.LimitReader(r, maxChunkBytes+1))
+	if err != nil {
+		return 0, err
+	}
+	if n > maxChunkBytes {
+		Handle(fileStorage.Delete(chunkKey(transferID, offset)))
+		return 0, fmt.Errorf("chunk exceeds %v", BytesToReadable(maxChunkBytes))
+	}
+	return int(n), removeOverlappingChunks(transferID, Chunk{Offset: offset, Size: int(n)})
+}
+
+// removeOverlappingChunks deletes the other chunks of a transfer that share any bytes with chunk
+func removeOverlappingChunks(transferID int64, chunk Chunk) error {
+	chunks, err := ReceivedChunks(transferID)
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if c.Offset != chunk.Offset && c.Offset < chunk.Offset+chunk.Size && chunk.Offset < c.Offset+c.Size {
+			if err := fileStorage.Delete(chunkKey(transferID, c.Offset)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AssembleChunks joins all the chunks of a transfer into the file at filePath and returns the sha256 hash and size
+// of the file. The chunks must cover the file from the first to the last byte without any gaps and add up to exactly
+// expectedSize.
+func AssembleChunks(transferID int64, filePath string, expectedSize int) (hash string, size int, err error) {
+	chunks, err := ReceivedChunks(transferID)
+	if err != nil {
+		return
+	}
+	if len(chunks) == 0 {
+		err = errors.New("no chunks received")
+		return
+	}
+	for _, chunk := range chunks {
+		if chunk.Offset != size {
+			err = fmt.Errorf("missing chunk at offset %d", size)
+			return
+		}
+		size += chunk.Size
+	}
+	if size < expectedSize {
+		err = fmt.Errorf("missing chunk at offset %d", size)
+		return
+	} else if size > expectedSize {
+		err = ErrTooLarge
+		return
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		for _, chunk := range chunks {
+			if err := appendChunk(pw, transferID, chunk); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	hash, size, err = StoreFile(fileStorage, filePath, pr, expectedSize)
+	pr.Close()
+	if err != nil {
+		return
+	}
+	err = deleteChunkDir(transferID)
+	return
+}
+
+func appendChunk(w io.Writer, transferID int64, chunk Chunk) error {
+	r, err := fileStorage.Get(chunkKey(transferID, chunk.Offset), 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func deleteChunkDir(transferID int64) error {
+	return DeletePrefix(fileStorage, chunkDir(transferID))
+}
+
+// cleanStaleChunks removes chunks of uploads that have not been touched for staleChunkHours
+func cleanStaleChunks() {
+	objects, err := fileStorage.List(chunkDirName + "/")
+	if err != nil {
+		Handle(err)
+		return
+	}
+
+	// only remove chunks of a transfer once none of them have been touched
+	latest := make(map[string]time.Time)
+	for _, object := range objects {
+		dir := strings.TrimSuffix(path.Dir(object.Key), "/") + "/"
+		if object.ModTime.After(latest[dir]) {
+			latest[dir] = object.ModTime
+		}
+	}
+	for dir, modTime := range latest {
+		if time.Since(modTime) > time.Hour*staleChunkHours {
+			Handle(DeletePrefix(fileStorage, dir))
+		}
+	}
+}
@@ -59,3 +59,14 @@ func GetCredit(db *sql.DB, user User) (credit sql.NullFloat64) {
 	Handle(result.Scan(&credit))
 	return credit
 }
+
+// HasCreditEmail checks whether email is attached to any of the credit of a user
+func HasCreditEmail(db *sql.DB, user User, email string) bool {
+	var count int
+	result := db.QueryRow(`SELECT COUNT(*)
+	FROM credit
+	WHERE UUID = ?
+	AND LOWER(email) = LOWER(?)`, Hash(user.UUID), email)
+	Handle(result.Scan(&count))
+	return count > 0
+}
@@ -18,3 +18,16 @@ func dbConn(dataSourceName string) (db *sql.DB, err error) {
 	err = db.Ping()
 	return
 }
+
+// inTx runs fn in a transaction that is committed if fn succeeds and rolled back if it fails
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		Handle(tx.Rollback())
+		return err
+	}
+	return tx.Commit()
+}
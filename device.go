@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxDevices is the number of devices an account can register on top of the device that created it
+	maxDevices = 10
+	// deviceIDHeader identifies which registered device of the account a request comes from. Requests without it
+	// come from the device that created the account.
+	deviceIDHeader = "Device-ID"
+	// devicePasswordPrefix followed by a device ID is the name of the password encrypted with the public key of
+	// that device when completing an upload
+	devicePasswordPrefix = "device_password_"
+	// cancelReasonClaimed is sent to the other devices of an account once one of them accepts a transfer
+	cancelReasonClaimed = "claimed"
+)
+
+// Device is an extra client of an account with its own public key and socket
+type Device struct {
+	ID         string    `json:"device_id"`
+	Name       string    `json:"name"`
+	PublicKey  string    `json:"public_key"`
+	Connected  bool      `json:"is_connected"`
+	Registered time.Time `json:"registered"`
+}
+
+// DeviceRequest registers a device or updates the name and public key of an existing one
+type DeviceRequest struct {
+	DeviceID  string `json:"device_id"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+}
+
+// RemoveDeviceRequest is the device to remove
+type RemoveDeviceRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+// Store stores the device for the user updating the name and public key if it already exists
+func (device Device) Store(db *sql.DB, user User) error {
+	_, err := db.Exec(`
+	INSERT INTO device (UUID, device_id, name, public_key, registered_dttm)
+	VALUES (?, ?, ?, ?, NOW())
+	ON DUPLICATE KEY UPDATE name = VALUES(name), public_key = VALUES(public_key)`,
+		Hash(user.UUID), device.ID, device.Name, device.PublicKey)
+	return err
+}
+
+// GetDevices fetches all the devices registered to the user with UUID
+func GetDevices(db *sql.DB, UUID string) ([]Device, error) {
+	rows, err := db.Query(`
+	SELECT device_id, name, public_key, is_connected, registered_dttm
+	FROM device
+	WHERE UUID = ?
+	ORDER BY id`, Hash(UUID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var device Device
+		if err := rows.Scan(&device.ID, &device.Name, &device.PublicKey, &device.Connected,
+			&device.Registered); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// DeviceExists returns true if the user with UUID has registered the device
+func DeviceExists(db *sql.DB, UUID string, deviceID string) bool {
+	var id int
+	err := db.QueryRow(`
+	SELECT id
+	FROM device
+	WHERE UUID = ?
+	AND device_id = ?`, Hash(UUID), deviceID).Scan(&id)
+	return err == nil && id > 0
+}
+
+// RegisterDevice adds a device to the account of user
+func (s *Server) RegisterDevice(user User, req DeviceRequest) (Device, error) {
+	device := Device{ID: req.DeviceID, Name: req.Name, PublicKey: req.PublicKey}
+	if !IsValidUUID(device.ID) {
+		return device, ErrInvalidForm.WithMessage("Invalid device_id")
+	}
+	if !IsValidPublicKey(device.PublicKey) {
+		return device, ErrInvalidPublicKey
+	}
+
+	if !DeviceExists(s.db, user.UUID, device.ID) {
+		devices, err := GetDevices(s.db, user.UUID)
+		if err != nil {
+			Handle(err)
+			return device, ErrInternal.WithMessage("Failed to fetch devices")
+		}
+		if len(devices) >= maxDevices {
+			return device, ErrTooManyDevices
+		}
+	}
+
+	if err := device.Store(s.db, user); err != nil {
+		Handle(err)
+		return device, ErrInternal.WithMessage("Failed to store device")
+	}
+	device.Registered = time.Now()
+	return device, nil
+}
+
+// ListDevices returns every device registered to the account of user
+func (s *Server) ListDevices(user User) ([]Device, error) {
+	devices, err := GetDevices(s.db, user.UUID)
+	if err != nil {
+		Handle(err)
+		return devices, ErrInternal.WithMessage("Failed to fetch devices")
+	}
+	return devices, nil
+}
+
+// RemoveDevice removes a device and the messages waiting for it from the account of user and disconnects its socket
+func (s *Server) RemoveDevice(user User, deviceID string) error {
+	err := UpdateErr(s.db.Exec(`
+	DELETE FROM device
+	WHERE UUID = ?
+	AND device_id = ?`, Hash(user.UUID), deviceID))
+	if err != nil {
+		return ErrDeviceNotFound
+	}
+	_, err = s.db.Exec(`
+	DELETE FROM pending_message
+	WHERE UUID = ?
+	AND device_id = ?`, Hash(user.UUID), deviceID)
+	Handle(err)
+	WSConns.Disconnect(user.UUID, deviceID)
+	return nil
+}
+
+// DeviceKeys returns the public keys of the registered devices of the friends with codes by code and device ID
+func (s *Server) DeviceKeys(codes []string) map[string]map[string]string {
+	keys := make(map[string]map[string]string)
+	for _, code := range codes {
+		friend := CodeToUser(s.db, code)
+		if friend.UUID == "" {
+			continue
+		}
+		devices, err := GetDevices(s.db, friend.UUID)
+		Handle(err)
+		for _, device := range devices {
+			if keys[code] == nil {
+				keys[code] = make(map[string]string)
+			}
+			keys[code][device.ID] = device.PublicKey
+		}
+	}
+	return keys
+}
+
+// ClaimTransfer claims the transfer for the device of user. The first time it is claimed the other devices of the
+// account are told to stop offering it.
+func (s *Server) ClaimTransfer(user User, transfer Transfer) error {
+	first, ok := transfer.Claim(s.db, user)
+	if !ok {
+		return ErrTransferClaimed
+	}
+	if first {
+		WSConns.WriteOthers(SocketMessage{
+			Cancel: &Cancel{FilePath: transfer.FilePath, Reason: cancelReasonClaimed},
+		}, user.UUID, user.DeviceID)
+	}
+	return nil
+}
+
+// RegisterDeviceHandler is the form handler for RegisterDevice
+func (s *Server) RegisterDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	device, err := s.RegisterDevice(user, DeviceRequest{
+		DeviceID:  r.Form.Get("device_id"),
+		Name:      r.Form.Get("name"),
+		PublicKey: r.Form.Get("public_key"),
+	})
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	Handle(WriteJSON(w, device))
+}
+
+// DevicesHandler is the form handler for ListDevices
+func (s *Server) DevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	devices, err := s.ListDevices(user)
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	Handle(WriteJSON(w, devices))
+}
+
+// RemoveDeviceHandler is the form handler for RemoveDevice
+func (s *Server) RemoveDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	if err := s.RemoveDevice(user, r.Form.Get("device_id")); err != nil {
+		WriteError(w, r, AsAPIError(err))
+	}
+}
+
+// V1RegisterDeviceHandler is the JSON handler for RegisterDevice
+func (s *Server) V1RegisterDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var req DeviceRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	device, err := s.RegisterDevice(user, req)
+	writeJSONResult(w, r, device, err)
+}
+
+// V1RemoveDeviceHandler is the JSON handler for RemoveDevice
+func (s *Server) V1RemoveDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var req RemoveDeviceRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	writeJSONResult(w, r, nil, s.RemoveDevice(user, req.DeviceID))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// registerDevice registers a new device for the user returning the header the device authenticates with
+func registerDevice(t *testing.T, header http.Header) (device Device, deviceHeader http.Header) {
+	rr := postJSON(DeviceRequest{DeviceID: uuid.New().String(), Name: "laptop", PublicKey: testB64PubKey}, header,
+		http.HandlerFunc(s.V1RegisterDeviceHandler))
+	if err := json.Unmarshal(rr.Body.Bytes(), &device); rr.Code != 200 || err != nil || device.ID == "" {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	deviceHeader = http.Header{}
+	for key := range header {
+		deviceHeader.Set(key, header.Get(key))
+	}
+	deviceHeader.Set(deviceIDHeader, device.ID)
+	return
+}
+
+func connectDeviceWSS(header http.Header) *websocket.Conn {
+	wsheader := http.Header{}
+	for key := range header {
+		wsheader.Set(key, header.Get(key))
+	}
+	wsheader.Set("Version", "2.0")
+	_, _, ws, _ := connectWSSHeader(wsheader)
+	return ws
+}
+
+func TestDevices(t *testing.T) {
+	_, header := v1User(t)
+
+	rr := postJSON(DeviceRequest{DeviceID: "foo", PublicKey: testB64PubKey}, header,
+		http.HandlerFunc(s.V1RegisterDeviceHandler))
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrInvalidForm.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+	rr = postJSON(DeviceRequest{DeviceID: uuid.New().String(), PublicKey: "foo"}, header,
+		http.HandlerFunc(s.V1RegisterDeviceHandler))
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrInvalidPublicKey.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+
+	device, deviceHeader := registerDevice(t, header)
+
+	// the device authenticates with the credentials of the account
+	rr = postRequestWithHeader(url.Values{}, deviceHeader, http.HandlerFunc(s.DevicesHandler))
+	var devices []Device
+	_ = json.Unmarshal(rr.Body.Bytes(), &devices)
+	if rr.Code != 200 || len(devices) != 1 || devices[0].ID != device.ID || devices[0].Name != "laptop" {
+		t.Errorf("Got %v (%v)", rr.Code, rr.Body)
+	}
+
+	// devices that are not registered to the account are rejected
+	deviceHeader.Set(deviceIDHeader, uuid.New().String())
+	rr = postRequestWithHeader(url.Values{}, deviceHeader, http.HandlerFunc(s.DevicesHandler))
+	if e := readError(rr); rr.Code != 401 || e.Code != ErrInvalidCredentials.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	rr = postJSON(RemoveDeviceRequest{DeviceID: device.ID}, header, http.HandlerFunc(s.V1RemoveDeviceHandler))
+	if rr.Code != 204 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+	rr = postRequestWithHeader(url.Values{"device_id": {device.ID}}, header, http.HandlerFunc(s.RemoveDeviceHandler))
+	if e := readError(rr); rr.Code != 404 || e.Code != ErrDeviceNotFound.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+}
+
+func TestDeviceFanOutAndClaim(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	device, deviceHeader := registerDevice(t, header2)
+
+	ws := connectDeviceWSS(header2)
+	defer ws.Close()
+	deviceWs := connectDeviceWSS(deviceHeader)
+	defer deviceWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+	if len(WSConns.GetConns(Hash(user2.UUID))) != 2 {
+		t.Fatalf("expected both devices to be connected")
+	}
+
+	// the sender encrypts the password for every device of the friend
+	fileBytes := []byte(RandomString(100))
+	rr := postJSON(InitUploadRequest{Filesize: len(fileBytes), Codes: []string{user2.Code}}, header1,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var initUpload InitUploadResponse
+	_ = json.Unmarshal(rr.Body.Bytes(), &initUpload)
+	if rr.Code != 200 || initUpload.DeviceKeys[user2.Code][device.ID] != testB64PubKey {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	credentials := url.Values{"UUID": {user1.UUID}, "UUID_key": {user1.UUIDKey}}
+	if rr = uploadChunk(credentials, strconv.FormatInt(initUpload.TransferID, 10), 0, fileBytes); rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	rr = postJSON(CompleteUploadRequest{
+		TransferID: initUpload.TransferID,
+		Filename:   "foo.bar",
+		Passwords:  map[string]string{"password": "account", devicePasswordPrefix + device.ID: "device"},
+	}, header1, http.HandlerFunc(s.V1UploadCompleteHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+
+	// every connected device is offered the download
+	var offer Transfer
+	for _, conn := range []*websocket.Conn{ws, deviceWs} {
+		frame := readSocketFrame(t, conn)
+		for frame.Type == socketTypeProgress {
+			frame = readSocketFrame(t, conn)
+		}
+		if frame.Type != socketTypeDownloadOffer || json.Unmarshal(frame.Payload, &offer) != nil {
+			t.Fatalf("got %+v", frame)
+		}
+	}
+
+	// the first device to download claims the transfer
+	rr = postRequestWithHeader(url.Values{"file_path": {offer.FilePath}}, deviceHeader,
+		http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 200 || rr.Body.String() != string(fileBytes) {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	frame := readSocketFrame(t, ws)
+	var cancel Cancel
+	_ = json.Unmarshal(frame.Payload, &cancel)
+	if frame.Type != socketTypeCancel || cancel.FilePath != offer.FilePath || cancel.Reason != cancelReasonClaimed {
+		t.Errorf("got %+v", frame)
+	}
+	rr = postRequestWithHeader(url.Values{"file_path": {offer.FilePath}}, header2, http.HandlerFunc(s.DownloadHandler))
+	if e := readError(rr); rr.Code != 409 || e.Code != ErrTransferClaimed.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 409)
+	}
+
+	// the device receives the password that was encrypted for it
+	rr = postJSON(CompleteDownloadRequest{FilePath: offer.FilePath, Hash: HashWithBytes(fileBytes)}, deviceHeader,
+		http.HandlerFunc(s.V1CompletedDownloadHandler))
+	var passwordResponse PasswordResponse
+	_ = json.Unmarshal(rr.Body.Bytes(), &passwordResponse)
+	if rr.Code != 200 || passwordResponse.Password != "device" {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, "device")
+	}
+}
+
+func TestDeviceFormUpload(t *testing.T) {
+	user1, form1 := genUser()
+	user2, header2 := v1User(t)
+	device, deviceHeader := registerDevice(t, header2)
+
+	deviceWs := connectDeviceWSS(deviceHeader)
+	defer deviceWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	// the form upload accepts the password encrypted for the device
+	fileBytes := []byte(RandomString(100))
+	initUploadR := initUpload(form1, user1, user2, len(fileBytes))
+	if initUploadR.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", initUploadR.Code, initUploadR.Body, 200)
+	}
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "foo.bar")
+	_, _ = part.Write(fileBytes)
+	_ = writer.WriteField("password", "account")
+	_ = writer.WriteField(devicePasswordPrefix+device.ID, "device")
+	_ = writer.Close()
+	req, _ := http.NewRequest("POST", "", body)
+	req.Header.Set("Cookie", initUploadR.Header().Get("Set-Cookie"))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.UploadHandler).ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	var offer Transfer
+	frame := readSocketFrame(t, deviceWs)
+	for frame.Type == socketTypeProgress {
+		frame = readSocketFrame(t, deviceWs)
+	}
+	if frame.Type != socketTypeDownloadOffer || json.Unmarshal(frame.Payload, &offer) != nil {
+		t.Fatalf("got %+v", frame)
+	}
+	rr = postRequestWithHeader(url.Values{"file_path": {offer.FilePath}}, deviceHeader,
+		http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 200 || rr.Body.String() != string(fileBytes) {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// the device receives the password that was encrypted for it
+	rr = postJSON(CompleteDownloadRequest{FilePath: offer.FilePath, Hash: HashWithBytes(fileBytes)}, deviceHeader,
+		http.HandlerFunc(s.V1CompletedDownloadHandler))
+	var passwordResponse PasswordResponse
+	_ = json.Unmarshal(rr.Body.Bytes(), &passwordResponse)
+	if rr.Code != 200 || passwordResponse.Password != "device" {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, "device")
+	}
+}
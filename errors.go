@@ -0,0 +1,74 @@
+package main
+
+import "net/http"
+
+// APIError is an error returned to clients. Code is stable so clients can handle the error without matching the
+// Message.
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// WithMessage returns a copy of the error with a more specific message
+func (e APIError) WithMessage(message string) APIError {
+	e.Message = message
+	return e
+}
+
+// error catalogue
+var (
+	ErrInvalidMethod       = APIError{http.StatusMethodNotAllowed, "invalid_method", "Invalid method"}
+	ErrInvalidForm         = APIError{http.StatusBadRequest, "invalid_form", "Invalid form data"}
+	ErrInvalidVersion      = APIError{http.StatusBadRequest, "invalid_version", "Invalid Version"}
+	ErrInvalidServerKey    = APIError{http.StatusUnauthorized, "invalid_server_key", "Invalid server key"}
+	ErrInvalidCredentials  = APIError{http.StatusUnauthorized, "invalid_credentials", "Invalid credentials!"}
+	ErrInvalidUUIDKey      = APIError{http.StatusUnauthorized, "invalid_uuid_key", "Invalid UUID key. Recover your key to reset it"}
+	ErrInvalidPublicKey    = APIError{http.StatusBadRequest, "invalid_public_key", "Invalid public key in keychain!"}
+	ErrInvalidRecoveryCode = APIError{http.StatusUnauthorized, "invalid_recovery_code", "Invalid recovery code"}
+	ErrInvalidCustomCode   = APIError{http.StatusBadRequest, "invalid_custom_code", "Invalid custom code"}
+	ErrInvalidCreditCode   = APIError{http.StatusBadRequest, "invalid_credit_code", "Failed to register credit"}
+	ErrInsufficientCredit  = APIError{http.StatusPaymentRequired, "insufficient_credit", "Not enough credit for this feature"}
+	ErrInvalidFilesize     = APIError{http.StatusBadRequest, "invalid_filesize", "Invalid value for filesize"}
+	ErrInvalidMaxDownloads = APIError{http.StatusBadRequest, "invalid_max_downloads", "Invalid value for max_downloads"}
+	ErrInvalidRetention    = APIError{http.StatusBadRequest, "invalid_retention", "Invalid value for retention_mins"}
+	ErrInvalidManifest     = APIError{http.StatusBadRequest, "invalid_manifest", "Invalid manifest"}
+	ErrInvalidFilename     = APIError{http.StatusBadRequest, "invalid_filename", "Invalid filename"}
+	ErrInvalidOffset       = APIError{http.StatusBadRequest, "invalid_offset", "Invalid value for offset"}
+	ErrInvalidRange        = APIError{http.StatusRequestedRangeNotSatisfiable, "invalid_range", "Invalid range"}
+	ErrFriendNotFound      = APIError{http.StatusNotFound, "friend_not_found", "Your friend does not exist!"}
+	ErrSendToSelf          = APIError{http.StatusBadRequest, "send_to_self", "You can't send files to yourself!"}
+	ErrTooManyRecipients   = APIError{http.StatusBadRequest, "too_many_recipients", "Too many friends"}
+	ErrBandwidthExceeded   = APIError{http.StatusForbidden, "bandwidth_exceeded", "This transfer exceeds today's bandwidth limit!"}
+	ErrFileTooLarge        = APIError{http.StatusRequestEntityTooLarge, "file_too_large", "File too large"}
+	ErrTransferNotFound    = APIError{http.StatusNotFound, "transfer_not_found", "Init transfer not run"}
+	ErrFileNotFound        = APIError{http.StatusNotFound, "file_not_found", "No such file in transfer!"}
+	ErrFileMismatch        = APIError{http.StatusBadRequest, "file_mismatch", "File does not match manifest"}
+	ErrMissingChunk        = APIError{http.StatusBadRequest, "missing_chunk", "Missing chunk"}
+	ErrIncompleteUpload    = APIError{http.StatusConflict, "incomplete_upload", "Upload is incomplete"}
+	ErrDeviceNotFound      = APIError{http.StatusNotFound, "device_not_found", "No such device"}
+	ErrTooManyDevices      = APIError{http.StatusForbidden, "too_many_devices", "Too many devices"}
+	ErrTransferClaimed     = APIError{http.StatusConflict, "transfer_claimed", "The transfer has been accepted by another device"}
+	ErrOfferNotFound       = APIError{http.StatusNotFound, "offer_not_found", "No such offer waiting for an answer"}
+	ErrAwaitingConsent     = APIError{http.StatusConflict, "awaiting_consent", "Your friend has not accepted the transfer yet"}
+	ErrPeerOffline         = APIError{http.StatusConflict, "peer_offline", "Your friend is not connected"}
+	ErrIllegalTransition   = APIError{http.StatusConflict, "illegal_transition", "The transfer can no longer change to that state"}
+	ErrPasswordNotFound    = APIError{http.StatusNotFound, "password_not_found", "No password for user"}
+	ErrInvalidMessage      = APIError{http.StatusBadRequest, "invalid_message", "Invalid socket message"}
+	ErrNotEnabled          = APIError{http.StatusServiceUnavailable, "not_enabled", "Not enabled"}
+	ErrRateLimited         = APIError{http.StatusTooManyRequests, "rate_limited", "Too many requests. Try again later"}
+	ErrInternal            = APIError{http.StatusInternalServerError, "internal_error", "Internal error"}
+)
+
+// AsAPIError converts err to an APIError. Errors that are not an APIError are reported and returned as ErrInternal.
+func AsAPIError(err error) APIError {
+	if e, ok := err.(APIError); ok {
+		return e
+	}
+	Handle(err)
+	return ErrInternal
+}
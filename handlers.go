@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -21,32 +23,13 @@ var (
 	}
 )
 
-const uploadSessionName = "upload"
-
-// TogglePermCodeHandler either turns on or off a users perm code depending if they have one already
-func (s *Server) TogglePermCodeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		WriteError(w, r, 400, "Invalid method")
-		return
-	}
-
-	// fetch post data
-	if err := r.ParseForm(); err != nil {
-		WriteError(w, r, 400, "Invalid form data")
-		return
-	}
-
-	user := User{
-		UUID:    r.Form.Get("UUID"),
-		UUIDKey: r.Form.Get("UUID_key"),
-	}
-
-	if !user.IsValid(s.db) {
-		log.Println("Invalid credentials")
-		WriteError(w, r, 400, "Invalid form data")
-		return
-	}
+const (
+	uploadSessionName    = "upload"
+	maxFormOverheadBytes = 1 << 20
+)
 
+// TogglePermCode either turns on or off a users perm code depending if they have one already
+func (s *Server) TogglePermCode(user User) (User, error) {
 	user.GetTier(s.db)
 	if user.Tier >= permUserTier {
 		permCode, customCode := GetUserPermCode(s.db, user)
@@ -58,123 +41,152 @@ func (s *Server) TogglePermCodeHandler(w http.ResponseWriter, r *http.Request) {
 			// turn on random perm code
 			user.Code = GenCode(s.db)
 			if err := SetPermCode(s.db, user); err != nil {
-				WriteError(w, r, 401, "Failed to set permanent code")
-				return
+				Handle(err)
+				return user, ErrInternal.WithMessage("Failed to set permanent code")
 			}
 		}
 	}
-
-	Handle(WriteJSON(w, user))
+	return user, nil
 }
 
-// CustomCodeHandler sets a users custom code
-func (s *Server) CustomCodeHandler(w http.ResponseWriter, r *http.Request) {
+// TogglePermCodeHandler is the form handler for TogglePermCode
+func (s *Server) TogglePermCodeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		WriteError(w, r, 400, "Invalid method")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 
-	// fetch form
+	// fetch post data
 	if err := r.ParseForm(); err != nil {
-		WriteError(w, r, 400, "Invalid form data")
+		WriteError(w, r, ErrInvalidForm)
 		return
 	}
 
-	user := User{
-		UUID:    r.Form.Get("UUID"),
-		UUIDKey: r.Form.Get("UUID_key"),
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
 	}
 
-	if !user.IsValid(s.db) {
-		WriteError(w, r, 400, "Invalid form data")
+	user, err := s.TogglePermCode(user)
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
 		return
 	}
+	Handle(WriteJSON(w, user))
+}
 
-	user.Code = r.Form.Get("custom_code")
+// CustomCode sets a users custom code
+func (s *Server) CustomCode(user User, code string) (User, error) {
+	user.Code = code
 	if len(user.Code) != codeLen {
-		WriteError(w, r, 401, "Invalid custom code")
-		return
+		return user, ErrInvalidCustomCode
 	}
 
 	user.GetTier(s.db)
-	if user.Tier >= customCodeUserTier {
-		err := SetCustomCode(s.db, user)
-		if err == nil {
-			Handle(WriteJSON(w, user))
-			return
-		}
+	if user.Tier < customCodeUserTier {
+		return user, ErrInsufficientCredit
+	}
+	if err := SetCustomCode(s.db, user); err != nil {
 		Handle(err)
+		return user, ErrInternal.WithMessage("Failed to set custom code")
 	}
-	WriteError(w, r, 402, "Failed to set activation code")
+	return user, nil
 }
 
-// RegisterCreditHandler will associate a credit code to an account
-func (s *Server) RegisterCreditHandler(w http.ResponseWriter, r *http.Request) {
+// CustomCodeHandler is the form handler for CustomCode
+func (s *Server) CustomCodeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		WriteError(w, r, 400, "Invalid method")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 
 	// fetch form
 	if err := r.ParseForm(); err != nil {
-		WriteError(w, r, 400, "Invalid form data")
+		WriteError(w, r, ErrInvalidForm)
 		return
 	}
 
-	user := User{
-		UUID:    r.Form.Get("UUID"),
-		UUIDKey: r.Form.Get("UUID_key"),
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
 	}
 
-	if !user.IsValid(s.db) {
-		WriteError(w, r, 400, "Invalid form data")
+	user, err := s.CustomCode(user, r.Form.Get("custom_code"))
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
 		return
 	}
+	Handle(WriteJSON(w, user))
+}
 
-	creditCode := r.Form.Get("credit_code")
-	if len(creditCode) == CreditCodeLen {
-		if err := SetCreditCode(s.db, user, creditCode); err != nil {
-			WriteError(w, r, 401, "Failed to register credit")
-			return
-		}
+// RegisterCredit will associate a credit code to an account
+func (s *Server) RegisterCredit(user User, creditCode string) error {
+	if len(creditCode) != CreditCodeLen {
+		return nil
 	}
+	if err := SetCreditCode(s.db, user, creditCode); err != nil {
+		Handle(err)
+		return ErrInvalidCreditCode
+	}
+	return nil
 }
 
-// CreateCodeHandler creates an account and/or updates a users code
-func (s *Server) CreateCodeHandler(w http.ResponseWriter, r *http.Request) {
+// RegisterCreditHandler is the form handler for RegisterCredit
+func (s *Server) RegisterCreditHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		WriteError(w, r, 400, "Invalid method")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 
 	// fetch form
 	if err := r.ParseForm(); err != nil {
-		WriteError(w, r, 400, "Invalid form data")
+		WriteError(w, r, ErrInvalidForm)
 		return
 	}
 
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	if err := s.RegisterCredit(user, r.Form.Get("credit_code")); err != nil {
+		WriteError(w, r, AsAPIError(err))
+	}
+}
+
+// CodeRequest describes the account a user wants from CreateCode
+type CodeRequest struct {
+	UUID       string `json:"UUID"`
+	UUIDKey    string `json:"UUID_key"`
+	PublicKey  string `json:"public_key"`
+	WantedMins int    `json:"wanted_mins"`
+	PermCode   string `json:"perm_user_code"`
+}
+
+// CreateCode creates an account and/or updates a users code
+func (s *Server) CreateCode(req CodeRequest) (User, error) {
 	user := User{}
-	user.UUID = r.Form.Get("UUID")
-	user.UUIDKey = r.Form.Get("UUID_key")
-	user.PublicKey = r.Form.Get("public_key")
+	user.UUID = req.UUID
+	user.UUIDKey = req.UUIDKey
+	user.PublicKey = req.PublicKey
 
 	if user.UUID == "" {
-		WriteError(w, r, 400, "Invalid form data")
-		return
+		return user, ErrInvalidForm
 	}
 
 	if user.PublicKey == "" {
-		WriteError(w, r, 401, "Invalid form data")
-		return
+		return user, ErrInvalidPublicKey.WithMessage("Missing public key")
 	}
 
 	if !IsValidPublicKey(user.PublicKey) {
-		WriteError(w, r, 401, "Invalid public key in keychain!")
-		return
+		return user, ErrInvalidPublicKey
 	}
 
-	wantedMins, err := strconv.Atoi(r.Form.Get("wanted_mins")) // convert to int
-	if err != nil {
+	wantedMins := req.WantedMins
+	if wantedMins == 0 {
 		wantedMins = defaultAccountLifeMins
 	}
 	user.SetWantedMins(s.db, wantedMins)
@@ -183,8 +195,7 @@ func (s *Server) CreateCodeHandler(w http.ResponseWriter, r *http.Request) {
 	UUIDKey, userExists := user.GetUUIDKey(s.db)
 
 	if userExists && len(UUIDKey) > 0 && !user.IsValid(s.db) {
-		WriteError(w, r, 402, "Invalid UUID key. Ask hello@transferme.it to reset")
-		return
+		return user, ErrInvalidUUIDKey
 	} else if !userExists {
 		// create new tmi user
 		log.Println("Creating new user " + user.UUID)
@@ -207,66 +218,130 @@ func (s *Server) CreateCodeHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// set perm code at client request
-		expectedPermCode := r.Form.Get("perm_user_code")
-		if len(expectedPermCode) != 0 {
-			SetUsersPermCode(s.db, &user, expectedPermCode)
+		if len(req.PermCode) != 0 {
+			SetUsersPermCode(s.db, &user, req.PermCode)
 		}
 
 		user.Expiry = time.Now().Add(time.Minute * time.Duration(user.WantedMins)).UTC()
 		go user.Update(s.db)
 	}
-
-	Handle(WriteJSON(w, user))
+	return user, nil
 }
 
-// InitUploadHandler tells the server what to suspect in the UploadHandler and handles most file upload validation.
-// This is done before so as to not have to wait for the file to be transferred to the server.
-func (s *Server) InitUploadHandler(w http.ResponseWriter, r *http.Request) {
+// CreateCodeHandler is the form handler for CreateCode
+func (s *Server) CreateCodeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		WriteError(w, r, 400, "Invalid method")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 
 	// fetch form
 	if err := r.ParseForm(); err != nil {
-		WriteError(w, r, 400, "Invalid form data")
+		WriteError(w, r, ErrInvalidForm)
 		return
 	}
 
-	user := User{
-		UUID:    r.Form.Get("UUID"),
-		UUIDKey: r.Form.Get("UUID_key"),
-	}
-
-	if !user.IsValid(s.db) {
-		WriteError(w, r, 400, "Invalid method")
+	wantedMins, _ := strconv.Atoi(r.Form.Get("wanted_mins"))
+	user, err := s.CreateCode(CodeRequest{
+		UUID:       r.Form.Get("UUID"),
+		UUIDKey:    r.Form.Get("UUID_key"),
+		PublicKey:  r.Form.Get("public_key"),
+		WantedMins: wantedMins,
+		PermCode:   r.Form.Get("perm_user_code"),
+	})
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
 		return
 	}
+	Handle(WriteJSON(w, user))
+}
 
-	filesize, err := strconv.Atoi(r.Form.Get("filesize"))
-	if err != nil {
-		WriteError(w, r, 401, "Invalid value for filesize") // TODO test
-		return
+// InitUploadRequest describes a transfer to one or more friends. Files is set instead of Filesize for a bundle of
+// files.
+type InitUploadRequest struct {
+	Filesize int            `json:"filesize"`
+	Files    []TransferFile `json:"files"`
+	Codes    []string       `json:"codes"`
+	// Consent offers the transfer to every friend and only allows the upload once they have all answered
+	Consent  bool   `json:"consent"`
+	Filename string `json:"filename"`
+	// MaxDownloads is how many times each friend can download the file before it expires. Defaults to 1.
+	MaxDownloads int `json:"max_downloads,omitempty"`
+	// RetentionMins is how long the file is kept for once uploaded up to the RetentionMinsAllowed of the tier of the
+	// user. Defaults to defaultRetentionMins.
+	RetentionMins int `json:"retention_mins,omitempty"`
+}
+
+// InitUpload validates and stores a transfer before the file is uploaded so as to not have to wait for the file to be
+// transferred to the server. It returns the transfer to upload to and the public key of each friend by code.
+func (s *Server) InitUpload(user User, req InitUploadRequest) (Transfer, map[string]string, error) {
+	var transfer Transfer
+
+	filesize := req.Filesize
+	if req.Files != nil {
+		if err := ValidateManifest(req.Files); err != nil {
+			return transfer, nil, ErrInvalidManifest.WithMessage(err.Error())
+		}
+		filesize = ManifestSize(req.Files)
+	} else if filesize < 0 {
+		return transfer, nil, ErrInvalidFilesize
+	}
+	if len(req.Filename) > maxFilenameLen {
+		return transfer, nil, ErrInvalidFilename
+	}
+	if req.MaxDownloads < 0 || req.MaxDownloads > maxTransferDownloads {
+		return transfer, nil, ErrInvalidMaxDownloads.WithMessage(
+			fmt.Sprintf("A transfer can't be downloaded more than %d times!", maxTransferDownloads))
+	} else if req.MaxDownloads == 0 {
+		req.MaxDownloads = 1
 	}
 
-	code := r.Form.Get("code")
-	friend := CodeToUser(s.db, code)
-	if friend.UUID == "" || friend.PublicKey == "" {
-		WriteError(w, r, 402, "Your friend does not exist!")
-		return
+	// a transfer can be sent to a group of friends
+	if len(req.Codes) > maxGroupRecipients {
+		return transfer, nil, ErrTooManyRecipients.WithMessage(
+			fmt.Sprintf("You can't send to more than %d friends!", maxGroupRecipients))
 	}
+	var friends []User
+	publicKeys := make(map[string]string)
+	friendUUIDs := make(map[string]bool)
+	for _, code := range req.Codes {
+		friend := CodeToUser(s.db, code)
+		if friend.UUID == "" || friend.PublicKey == "" {
+			return transfer, nil, ErrFriendNotFound
+		}
+		if friendUUIDs[friend.UUID] {
+			continue
+		}
+		friendUUIDs[friend.UUID] = true
 
-	if friend.UUID == Hash(user.UUID) {
-		WriteError(w, r, 403, "Your can't send files to yourself!")
-		return
+		if friend.UUID == Hash(user.UUID) {
+			return transfer, nil, ErrSendToSelf
+		}
+		friend.Code = code
+		friends = append(friends, friend)
+		publicKeys[code] = friend.PublicKey
+	}
+	if len(friends) == 0 {
+		return transfer, nil, ErrFriendNotFound
 	}
 
-	user.GetWantedMins(s.db)
+	user.GetRetentionMinsAllowed(s.db)
+	retentionMins := req.RetentionMins
+	if retentionMins < 0 {
+		return transfer, nil, ErrInvalidRetention
+	} else if retentionMins == 0 {
+		retentionMins = defaultRetentionMins
+		if retentionMins > user.RetentionMinsAllowed {
+			retentionMins = user.RetentionMinsAllowed
+		}
+	} else if retentionMins > user.RetentionMinsAllowed {
+		m := fmt.Sprintf("You can't keep a file for more than %d minutes!", user.RetentionMinsAllowed)
+		return transfer, nil, ErrInsufficientCredit.WithMessage(m)
+	}
 
 	user.GetBandwidthLeft(s.db)
-	if user.BandwidthLeft-filesize < 0 {
-		WriteError(w, r, 404, "This transfer exceeds today's bandwidth limit!")
-		return
+	if user.BandwidthLeft-filesize*len(friends) < 0 {
+		return transfer, nil, ErrBandwidthExceeded
 	}
 
 	user.GetMaxFileSize(s.db)
@@ -274,23 +349,114 @@ func (s *Server) InitUploadHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("transfer with %v difference", BytesToMegabytes(user.MaxFileSize-filesize))
 		mb := BytesToMegabytes(user.MaxFileSize)
 		m := fmt.Sprintf("This transfer exceeds your %fMB max file transfer Size!", mb)
-		WriteError(w, r, 405, m)
-		return
+		return transfer, nil, ErrFileTooLarge.WithMessage(m)
 	}
 
-	transfer := Transfer{
-		from: user,
-		to:   User{UUID: friend.UUID},
-		Size: filesize,
+	// friends are told who is offering the transfer and the history of both keeps the code it was sent from
+	user.GetCode(s.db)
+	filename := req.Filename
+	if req.Consent && filename != "" {
+		filename = path.Base(filename)
 	}
 
-	if transfer.AlreadyToUser(s.db) {
-		// already uploading to friend so delete the currently in process transfer
-		go transfer.Completed(s.db, true, false)
+	// the first transfer of a group is the one that the file is uploaded to
+	for i, friend := range friends {
+		t := Transfer{
+			from:          user,
+			to:            User{UUID: friend.UUID, Code: friend.Code},
+			Size:          filesize,
+			MaxDownloads:  req.MaxDownloads,
+			retentionMins: retentionMins,
+		}
+
+		if t.AlreadyToUser(s.db) {
+			// already uploading to friend so delete the currently in process transfer
+			go t.Completed(s.db, true, false)
+		}
+
+		if i > 0 {
+			t.groupID = transfer.ID
+		}
+		t.ID = t.InitialStore(s.db)
+		if req.Consent {
+			if err := t.Offer(s.db, filename); err != nil {
+				Handle(err)
+				return transfer, nil, ErrInternal.WithMessage("Failed to offer transfer")
+			}
+		}
+		if i == 0 {
+			transfer = t
+			if len(friends) > 1 {
+				transfer.groupID = transfer.ID
+				Handle(transfer.StoreGroupID(s.db))
+			}
+		}
 	}
 
-	transfer.ID = transfer.InitialStore(s.db)
+	if req.Files != nil {
+		if err := transfer.StoreFiles(s.db, req.Files); err != nil {
+			Handle(err)
+			return transfer, nil, ErrInternal.WithMessage("Failed to store manifest")
+		}
+	}
 	transfer.from.UUID = "" // for privacy remove the UUID
+	return transfer, publicKeys, nil
+}
+
+// InitUploadHandler is the form handler for InitUpload. The transfer is stored in the session for the UploadHandler.
+func (s *Server) InitUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	// a manifest describes a transfer of multiple files
+	consent, _ := strconv.ParseBool(r.Form.Get("consent"))
+	maxDownloads, err := strconv.Atoi(r.Form.Get("max_downloads"))
+	if err != nil && r.Form.Get("max_downloads") != "" {
+		WriteError(w, r, ErrInvalidMaxDownloads)
+		return
+	}
+	retentionMins, err := strconv.Atoi(r.Form.Get("retention_mins"))
+	if err != nil && r.Form.Get("retention_mins") != "" {
+		WriteError(w, r, ErrInvalidRetention)
+		return
+	}
+	req := InitUploadRequest{Codes: r.Form["code"], Consent: consent, Filename: r.Form.Get("filename"),
+		MaxDownloads: maxDownloads, RetentionMins: retentionMins}
+	if manifest := r.Form.Get("manifest"); manifest != "" {
+		files, err := ParseManifest(manifest)
+		if err != nil {
+			WriteError(w, r, ErrInvalidManifest.WithMessage(err.Error()))
+			return
+		}
+		req.Files = files
+	} else {
+		filesize, err := strconv.Atoi(r.Form.Get("filesize"))
+		if err != nil {
+			WriteError(w, r, ErrInvalidFilesize)
+			return
+		}
+		req.Filesize = filesize
+	}
+
+	transfer, publicKeys, err := s.InitUpload(user, req)
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
 
 	// store transfer information in session to be picked up by UploadHandler
 	session := InitSession(r)
@@ -299,22 +465,37 @@ func (s *Server) InitUploadHandler(w http.ResponseWriter, r *http.Request) {
 	err = session.Save(r, w)
 	Handle(err)
 
-	_, err = w.Write([]byte(friend.PublicKey))
-	Handle(err)
+	// transfer ID used by chunked uploads
+	w.Header().Set("Transfer-ID", strconv.FormatInt(transfer.ID, 10))
+
+	if len(publicKeys) > 1 {
+		// public key of each friend so the password can be encrypted for each of them
+		Handle(WriteJSON(w, publicKeys))
+		return
+	}
+	for _, publicKey := range publicKeys {
+		_, err = w.Write([]byte(publicKey))
+		Handle(err)
+	}
 }
 
 // UploadHandler handles the file upload but only works after running InitUploadHandler
 func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		WriteError(w, r, 400, "Invalid method")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 
 	// get session transfer
 	session := InitSession(r)
-	sessionTransfer := session.Values[uploadSessionName].(Transfer)
+	sessionTransfer, _ := session.Values[uploadSessionName].(Transfer)
 	if sessionTransfer.ID == 0 {
-		WriteError(w, r, 401, "Init transfer not run")
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+	if sessionTransfer.AwaitingConsent(s.db) {
+		// keep the session so the upload can be sent again once the offer has been answered
+		WriteError(w, r, ErrAwaitingConsent)
 		return
 	}
 
@@ -323,152 +504,552 @@ func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
 	err := session.Save(r, w)
 	Handle(err)
 
-	err = r.ParseMultipartForm(int64(maxFileUploadSizeMB << 20))
-	Handle(err)
+	// rejected with ErrTransferNotFound once every friend has cancelled, declined or let the offer expire
+	if err := sessionTransfer.Uploading(s.db); err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	progress := TrackProgress(s.db, progressUpload, sessionTransfer, sessionTransfer.Parties(s.db)...)
 
-	// get POST data
-	if err := r.ParseForm(); err != nil {
+	// stop reading the body as soon as it can no longer be the size declared in InitUploadHandler
+	r.Body = http.MaxBytesReader(w, r.Body, int64(sessionTransfer.Size+maxFormOverheadBytes))
+	reader, err := r.MultipartReader()
+	if err != nil {
 		Handle(err)
-		WriteError(w, r, 400, "Invalid form data")
+		WriteError(w, r, ErrInvalidForm)
 		return
 	}
 
-	// get (encrypted with friends public key) password
-	sessionTransfer.password = r.Form.Get("password")
+	transfer := sessionTransfer
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			Handle(err)
+			WriteError(w, r, ErrInvalidForm)
+			go deleteUploadDir(transfer.FilePath)
+			return
+		}
+
+		switch name := part.FormName(); {
+		case name == "password" || strings.HasPrefix(name, groupPasswordPrefix) ||
+			strings.HasPrefix(name, devicePasswordPrefix):
+			// get (encrypted with friends public key) password
+			password, err := ioutil.ReadAll(io.LimitReader(part, maxFormOverheadBytes))
+			Handle(err)
+			transfer.SetPassword(name, string(password))
+		case name == "file":
+			if transfer.FilePath != "" {
+				WriteError(w, r, ErrInvalidForm)
+				go deleteUploadDir(transfer.FilePath)
+				return
+			}
 
-	// get file from form
-	file, handler, err := r.FormFile("file")
-	Handle(err)
-	defer file.Close()
+			// write file to storage while hashing it
+			transfer.FilePath = RandomString(userDirLen) + "/" + path.Base(part.FileName())
+			transfer.hash, transfer.Size, err = StoreFile(fileStorage, transfer.FilePath, progress.Reader(part),
+				sessionTransfer.Size)
+			if err != nil {
+				go deleteUploadDir(transfer.FilePath)
+				if err == ErrTooLarge {
+					// should be less than expected as it should have been compressed since.
+					m := fmt.Sprintf("You lied about the transfer size expected %v got more!", sessionTransfer.Size)
+					WriteError(w, r, ErrFileTooLarge.WithMessage(m))
+					return
+				}
+				Handle(err)
+				WriteError(w, r, ErrInvalidForm)
+				return
+			}
+		}
+		Handle(part.Close())
+	}
 
-	// verify session data from InitUploadHandler against actual file Size
-	// should be less than expected as it should have been compressed since.
-	if int(handler.Size) > sessionTransfer.Size {
-		m := fmt.Sprintf("You lied about the transfer size expected %v got %v!", sessionTransfer.Size, int(handler.Size))
-		WriteError(w, r, 401, m)
+	if transfer.FilePath == "" {
+		WriteError(w, r, ErrInvalidForm)
 		return
 	}
 
-	// extract file to bytes
-	fileBytes, err := ioutil.ReadAll(file)
-	Handle(err)
+	if err := transfer.Uploaded(s.db); err != nil {
+		// cancelled while the file was being uploaded
+		go deleteUploadDir(transfer.FilePath)
+		WriteError(w, r, AsAPIError(err))
+	}
+}
 
-	// write file to server
-	dir := fileStoreDirectory + RandomString(userDirLen)
-	err = os.MkdirAll(dir, 0744)
-	Handle(err)
-	fileLocation := dir + "/" + handler.Filename
-	err = ioutil.WriteFile(fileLocation, fileBytes, 0744)
-	Handle(err)
+// UploadFileHandler streams a single file of a bundle described by the manifest passed to InitUploadHandler.
+// The form values must be sent before the file.
+func (s *Server) UploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
 
-	// write full details in transfer struct
-	transfer := sessionTransfer
-	transfer.FilePath = strings.Replace(fileLocation, fileStoreDirectory, "", -1)
-	transfer.expiry = time.Now().Add(time.Minute * time.Duration(sessionTransfer.from.WantedMins))
-	transfer.hash = HashWithBytes(fileBytes)
-	transfer.Size = int(handler.Size)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	form := url.Values{}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			WriteError(w, r, ErrInvalidForm)
+			return
+		}
+		if part.FormName() != "file" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormOverheadBytes))
+			Handle(err)
+			form.Set(part.FormName(), string(value))
+			continue
+		}
+
+		r.Form = form
+		user, ok := s.MultipartUser(r)
+		if !ok {
+			WriteError(w, r, ErrInvalidCredentials)
+			return
+		}
+
+		transferID, _ := strconv.ParseInt(form.Get("transfer_id"), 10, 64)
+		transfer, ok := GetUploadingTransfer(s.db, user, transferID)
+		if !ok {
+			WriteError(w, r, ErrTransferNotFound)
+			return
+		}
+		if transfer.AwaitingConsent(s.db) {
+			WriteError(w, r, ErrAwaitingConsent)
+			return
+		}
 
-	Handle(transfer.Store(s.db))
+		if err := transfer.GetFiles(s.db); err != nil {
+			Handle(err)
+			WriteError(w, r, ErrInternal.WithMessage("Failed to fetch files"))
+			return
+		}
+		file, ok := transfer.GetFile(form.Get("path"))
+		if !ok {
+			WriteError(w, r, ErrFileNotFound)
+			return
+		}
+
+		if err := transfer.Uploading(s.db); err != nil {
+			WriteError(w, r, AsAPIError(err))
+			return
+		}
+		progress := TrackProgress(s.db, progressUpload, transfer, transfer.Parties(s.db)...)
+		hash, size, err := StoreFile(fileStorage, file.filePath, progress.Reader(part), file.Size)
+		if err != nil || hash != file.Hash || size != file.Size {
+			Handle(err)
+			Handle(fileStorage.Delete(file.filePath))
+			WriteError(w, r, ErrFileMismatch)
+			return
+		}
 
-	// tell friend to download file
-	WSConns.Write(SocketMessage{
-		Download: &transfer,
-	}, transfer.to.UUID, true)
+		Handle(transfer.FileUploaded(s.db, file))
+		return
+	}
 }
 
-// DownloadHandler handles the download of the file
-func (s *Server) DownloadHandler(w http.ResponseWriter, r *http.Request) {
+// UploadChunkHandler stores a single chunk of a file at an offset for a transfer created by InitUploadHandler.
+// Chunks can be sent in any order and resent after a dropped connection.
+func (s *Server) UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		WriteError(w, r, 400, "Invalid method")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 
-	// fetch form
-	if err := r.ParseForm(); err != nil {
+	if err := r.ParseMultipartForm(maxChunkBytes); err != nil {
 		Handle(err)
-		WriteError(w, r, 400, "Invalid form data")
+		WriteError(w, r, ErrInvalidForm)
 		return
 	}
 
-	// get encrypted (with friends public key) password
-	user := User{
-		UUID:    r.Form.Get("UUID"),
-		UUIDKey: r.Form.Get("UUID_key"),
+	user, ok := s.MultipartUser(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
 	}
 
-	if !user.IsValid(s.db) {
-		WriteError(w, r, 400, "Invalid form data")
+	transferID, _ := strconv.ParseInt(r.Form.Get("transfer_id"), 10, 64)
+	transfer, ok := GetUploadingTransfer(s.db, user, transferID)
+	if !ok {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+	if transfer.AwaitingConsent(s.db) {
+		WriteError(w, r, ErrAwaitingConsent)
 		return
 	}
 
-	filePath := r.Form.Get("file_path")
-	if !AllowedToDownload(s.db, user, filePath) {
-		WriteError(w, r, 401, "No such file at path!")
+	offset, err := strconv.Atoi(r.Form.Get("offset"))
+	if err != nil || offset < 0 {
+		WriteError(w, r, ErrInvalidOffset)
 		return
 	}
 
-	f, err := os.Open(fileStoreDirectory + filePath)
+	file, handler, err := r.FormFile("chunk")
 	if err != nil {
 		Handle(err)
-		WriteError(w, r, 401, err.Error())
+		WriteError(w, r, ErrMissingChunk)
+		return
+	}
+	defer file.Close()
+
+	if offset+int(handler.Size) > transfer.Size {
+		m := fmt.Sprintf("You lied about the transfer size expected %v got at least %v!", transfer.Size, offset+int(handler.Size))
+		WriteError(w, r, ErrFileTooLarge.WithMessage(m))
+		return
+	}
+
+	if err := transfer.Uploading(s.db); err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	progress := TrackProgress(s.db, progressUpload, transfer, transfer.Parties(s.db)...)
+	if _, err := StoreChunk(transfer.ID, offset, progress.Reader(file)); err != nil {
+		Handle(err)
+		WriteError(w, r, ErrInternal.WithMessage("Failed to store chunk"))
 		return
 	}
-	fi, err := f.Stat()
+}
+
+// UploadStatusHandler returns the chunks the server has already received for a transfer so that a client can
+// resume an upload
+func (s *Server) UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	transferID, _ := strconv.ParseInt(r.Form.Get("transfer_id"), 10, 64)
+	transfer, ok := GetUploadingTransfer(s.db, user, transferID)
+	if !ok {
+		WriteError(w, r, ErrTransferNotFound)
+		return
+	}
+
+	chunks, err := ReceivedChunks(transfer.ID)
 	if err != nil {
 		Handle(err)
-		WriteError(w, r, 401, err.Error())
+		WriteError(w, r, ErrInternal.WithMessage("Failed to read chunks"))
 		return
 	}
+	Handle(WriteJSON(w, chunks))
+}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Transfer-Encoding", "binary")
-	w.Header().Set("Content-Length", string(fi.Size()))
+// CompleteUploadRequest finishes a chunked or bundle upload. Passwords are keyed by the password form names used by
+// UploadHandler (password or password_<code>).
+type CompleteUploadRequest struct {
+	TransferID int64             `json:"transfer_id"`
+	Filename   string            `json:"filename"`
+	Passwords  map[string]string `json:"passwords"`
+}
 
-	_, err = io.Copy(w, f)
-	Handle(err)
+// CompleteUpload assembles all the chunks sent with UploadChunkHandler into the final file and tells the recipient to
+// download it
+func (s *Server) CompleteUpload(user User, req CompleteUploadRequest) error {
+	transfer, ok := GetUploadingTransfer(s.db, user, req.TransferID)
+	if !ok {
+		return ErrTransferNotFound
+	}
+	if transfer.AwaitingConsent(s.db) {
+		return ErrAwaitingConsent
+	}
+
+	if err := transfer.GetFiles(s.db); err != nil {
+		Handle(err)
+		return ErrInternal.WithMessage("Failed to fetch files")
+	}
+
+	if len(transfer.Files) > 0 {
+		// bundle of files uploaded with UploadFileHandler
+		for _, file := range transfer.Files {
+			if !file.uploaded {
+				return ErrIncompleteUpload.WithMessage("Missing file " + file.Path)
+			}
+		}
+		transfer.FilePath = transfer.BundleDir()
+		transfer.hash = ManifestHash(transfer.Files)
+		transfer.Size = ManifestSize(transfer.Files)
+	} else {
+		filename := path.Base(req.Filename)
+		if filename == "." || filename == "/" {
+			return ErrInvalidFilename
+		}
+
+		// join chunks into file in storage
+		var err error
+		transfer.FilePath = RandomString(userDirLen) + "/" + filename
+		transfer.hash, transfer.Size, err = AssembleChunks(transfer.ID, transfer.FilePath, transfer.Size)
+		if err != nil {
+			go deleteUploadDir(transfer.FilePath)
+			if err == ErrTooLarge {
+				return ErrFileTooLarge
+			}
+			return ErrIncompleteUpload.WithMessage(err.Error())
+		}
+	}
+
+	// write full details in transfer struct
+	for name, password := range req.Passwords {
+		if name == "password" || strings.HasPrefix(name, groupPasswordPrefix) ||
+			strings.HasPrefix(name, devicePasswordPrefix) {
+			transfer.SetPassword(name, password)
+		}
+	}
+	if err := transfer.Uploaded(s.db); err != nil {
+		// cancelled while the file was being uploaded
+		go deleteUploadDir(transfer.FilePath)
+		if e, ok := err.(APIError); ok {
+			return e
+		}
+		Handle(err)
+		return ErrInternal.WithMessage("Failed to store transfer")
+	}
+	return nil
 }
 
-// CompletedDownloadHandler fetches the encrypted password of the uploaded file if passed a valid file hash
-func (s *Server) CompletedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+// UploadCompleteHandler is the form handler for CompleteUpload
+func (s *Server) UploadCompleteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		WriteError(w, r, 400, "Invalid method")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 
 	// fetch form
 	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	transferID, _ := strconv.ParseInt(r.Form.Get("transfer_id"), 10, 64)
+	req := CompleteUploadRequest{
+		TransferID: transferID,
+		Filename:   r.Form.Get("filename"),
+		Passwords:  make(map[string]string),
+	}
+	for name := range r.Form {
+		req.Passwords[name] = r.Form.Get(name)
+	}
+	if err := s.CompleteUpload(user, req); err != nil {
+		WriteError(w, r, AsAPIError(err))
+	}
+}
+
+// DownloadHandler handles the download of the file
+func (s *Server) DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		Handle(err)
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	// get encrypted (with friends public key) password
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	filePath := r.Form.Get("file_path")
+	transfer, ok := AllowedToDownload(s.db, user, filePath)
+	if !ok {
+		WriteError(w, r, ErrFileNotFound.WithMessage("No such file at path!"))
+		return
+	}
+	if err := s.ClaimTransfer(user, transfer); err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+
+	if r.Header.Get("Range") != "" {
+		// prevent CleanExpiredTransfers from removing a transfer that is being resumed
+		go KeepAliveTransfer(s.db, user, filePath)
+	}
+
+	// the transfer is only downloading once the file is about to be served
+	started := func() error {
+		_, err := transfer.Transition(s.db, StateDownloading, "download started", nil)
+		return err
+	}
+
+	progress := TrackProgress(s.db, progressDownload, transfer, transfer.from.UUID, user.UUID)
+	if !transfer.IsBundle() {
+		serveFile(w, r, filePath, transfer.hash, progress, started)
+		return
+	}
+
+	if err := transfer.GetFiles(s.db); err != nil {
+		Handle(err)
+		WriteError(w, r, ErrInternal.WithMessage("Failed to fetch files"))
+		return
+	}
+
+	// serve a single file of the bundle
+	if p := r.Form.Get("file"); p != "" {
+		file, ok := transfer.GetFile(p)
+		if !ok {
+			WriteError(w, r, ErrFileNotFound)
+			return
+		}
+		serveFile(w, r, file.filePath, file.Hash, nil, started)
+		return
+	}
+
+	// stream the whole bundle
+	if err := started(); err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	progress.Seek(0)
+	Handle(transfer.WriteTar(progress.Writer(w)))
+}
+
+// serveFile writes the file at key in fileStorage supporting single Range requests. hash is used for the ETag so
+// that clients can resume the download with If-Range. The bytes written are counted by progress unless it is nil.
+// started is called once the request is known to be valid just before the file is written.
+func serveFile(w http.ResponseWriter, r *http.Request, key string, hash string, progress *ProgressTracker,
+	started func() error) {
+	fi, err := fileStorage.Stat(key)
+	if os.IsNotExist(err) {
+		WriteError(w, r, ErrFileNotFound)
+		return
+	} else if err != nil {
 		Handle(err)
-		WriteError(w, r, 400, "Invalid form data")
+		WriteError(w, r, ErrInternal)
 		return
 	}
 
-	var user = User{
-		UUID:    r.Form.Get("UUID"),
-		UUIDKey: r.Form.Get("UUID_key"),
+	etag := `"` + hash + `"`
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", etag)
+
+	// only resume the download if the file has not changed since the client started downloading it
+	rangeHeader := r.Header.Get("Range")
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		rangeHeader = ""
+	}
+
+	start, end := int64(0), fi.Size-1
+	if rangeHeader != "" {
+		var ok bool
+		start, end, ok = ParseRange(rangeHeader, fi.Size)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size))
+			WriteError(w, r, ErrInvalidRange)
+			return
+		}
 	}
 
-	if !user.IsValid(s.db) {
-		WriteError(w, r, 400, "Invalid form data")
+	f, err := fileStorage.Get(key, start, end-start+1)
+	if err != nil {
+		Handle(err)
+		WriteError(w, r, ErrInternal)
+		return
+	}
+	defer f.Close()
+	if err := started(); err != nil {
+		WriteError(w, r, AsAPIError(err))
 		return
 	}
 
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if rangeHeader != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fi.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	var dst io.Writer = w
+	if progress != nil {
+		progress.Seek(int(start))
+		dst = progress.Writer(w)
+	}
+	_, err = io.Copy(dst, f)
+	Handle(err)
+}
+
+// CompleteDownload fetches the encrypted password of the downloaded file if passed a valid file hash and marks the
+// transfer as completed. An empty hash marks the download as failed.
+func (s *Server) CompleteDownload(user User, filePath string, hash string) (string, error) {
 	var transfer = Transfer{
-		to:       User{UUID: user.UUID},
-		FilePath: r.Form.Get("file_path"),
-		hash:     r.Form.Get("hash"),
+		to:       User{UUID: user.UUID, DeviceID: user.DeviceID},
+		FilePath: filePath,
+		hash:     hash,
+	}
+	if err := s.ClaimTransfer(user, transfer); err != nil {
+		return "", err
 	}
 
+	var err error
 	failed := true
 	if transfer.hash != "" {
 		failed = false
 		transfer.GetPasswordAndUUID(s.db)
 		if transfer.password == "" || transfer.from.UUID == "" {
 			log.Println("No password for user. Or already uploading to user", transfer)
-			WriteError(w, r, 402, "No password for user")
+			err = ErrPasswordNotFound
 		}
-		_, err := w.Write([]byte(transfer.password))
-		Handle(err)
 	}
 
 	transfer.Completed(s.db, failed, false)
+	return transfer.password, err
+}
+
+// CompletedDownloadHandler is the form handler for CompleteDownload
+func (s *Server) CompletedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		Handle(err)
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	password, err := s.CompleteDownload(user, r.Form.Get("file_path"), r.Form.Get("hash"))
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	_, err = w.Write([]byte(password))
+	Handle(err)
 }
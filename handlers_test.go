@@ -1,9 +1,11 @@
 package main
 
 import (
+	"archive/tar"
 	"encoding/json"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptest"
@@ -23,6 +25,7 @@ func TestMain(m *testing.M) {
 	// clean up
 	_ = os.Remove("./foo.bar")
 	_ = os.RemoveAll("./upload")
+	_ = os.RemoveAll("./" + chunkDirName)
 }
 
 func TestCredentialHandler(t *testing.T) {
@@ -38,15 +41,15 @@ func TestCredentialHandler(t *testing.T) {
 	// create account with no public key
 	form.Set("UUID", UUID.String())
 	rr = postRequest(form, http.HandlerFunc(s.CreateCodeHandler))
-	if rr.Code != 401 {
-		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	if rr.Code != 400 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
 	}
 
 	// create account with invalid public key
 	form.Set("public_key", "not a key")
 	rr = postRequest(form, http.HandlerFunc(s.CreateCodeHandler))
-	if rr.Code != 401 {
-		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	if rr.Code != 400 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
 	}
 
 	// create account with valid public key
@@ -145,12 +148,350 @@ func TestUploadDownloadCycle(t *testing.T) {
 	}
 }
 
+func TestResumeDownload(t *testing.T) {
+	user1, form1 := genUser()
+	user2, form2 := genUser()
+
+	fileSize := 1000
+	_ = upload(t, user1, user2, form1, fileSize)
+
+	_, _, user2Ws, _ := connectWSS(user2, form2)
+	message := readSocketMessage(user2Ws)
+	user2Ws.Close()
+
+	form2.Set("UUID_key", user2.UUIDKey)
+	form2.Set("file_path", message.Download.FilePath)
+	rr := postRequest(form2, http.HandlerFunc(s.DownloadHandler))
+	etag := rr.Header().Get("ETag")
+	if rr.Code != 200 || rr.Header().Get("Content-Length") != strconv.Itoa(fileSize) || etag == "" {
+		t.Fatalf("Got %v %v expected %v", rr.Code, rr.Header(), 200)
+	}
+
+	// resume from byte 400
+	header := http.Header{}
+	header.Set("Range", "bytes=400-")
+	header.Set("If-Range", etag)
+	rr = postRequestWithHeader(form2, header, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 206 || rr.Body.Len() != fileSize-400 {
+		t.Errorf("Got %v (%v bytes) expected %v", rr.Code, rr.Body.Len(), 206)
+	}
+	if rr.Header().Get("Content-Range") != "bytes 400-999/1000" {
+		t.Errorf("Got %v", rr.Header().Get("Content-Range"))
+	}
+
+	// changed file so should send the whole file
+	header.Set("If-Range", `"not the hash"`)
+	rr = postRequestWithHeader(form2, header, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 200 || rr.Body.Len() != fileSize {
+		t.Errorf("Got %v (%v bytes) expected %v", rr.Code, rr.Body.Len(), 200)
+	}
+
+	// unsatisfiable range
+	header.Del("If-Range")
+	header.Set("Range", "bytes=5000-")
+	rr = postRequestWithHeader(form2, header, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 416 {
+		t.Errorf("Got %v expected %v", rr.Code, 416)
+	}
+
+	form2.Set("hash", strings.Trim(etag, `"`))
+	_ = postRequest(form2, http.HandlerFunc(s.CompletedDownloadHandler))
+}
+
+func TestChunkedUpload(t *testing.T) {
+	user1, form1 := genUser()
+	user2, form2 := genUser()
+
+	fileSize := 100
+	fileBytes := []byte(RandomString(fileSize))
+
+	initUploadR := initUpload(form1, user1, user2, fileSize)
+	transferID := initUploadR.Header().Get("Transfer-ID")
+	if initUploadR.Code != 200 || transferID == "" {
+		t.Fatalf("Got %v (%v) expected %v", initUploadR.Code, initUploadR.Body, 200)
+	}
+
+	// send second half of file first
+	rr := uploadChunk(form1, transferID, 60, fileBytes[60:])
+	if rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// chunk beyond the initialised size
+	rr = uploadChunk(form1, transferID, 60, fileBytes)
+	if rr.Code != 413 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 413)
+	}
+
+	// can't complete with missing first chunk
+	form1.Set("transfer_id", transferID)
+	form1.Set("filename", "foo.bar")
+	rr = postRequest(form1, http.HandlerFunc(s.UploadCompleteHandler))
+	if rr.Code != 409 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 409)
+	}
+
+	// resume upload from received offsets
+	rr = postRequest(form1, http.HandlerFunc(s.UploadStatusHandler))
+	var chunks []Chunk
+	_ = json.Unmarshal(rr.Body.Bytes(), &chunks)
+	if len(chunks) != 1 || chunks[0].Offset != 60 || chunks[0].Size != 40 {
+		t.Errorf("Got %v expected a single chunk at 60", rr.Body)
+	}
+
+	// a chunk sent again from an earlier offset replaces the chunk it overlaps
+	rr = uploadChunk(form1, transferID, 50, fileBytes[50:])
+	if rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	rr = postRequest(form1, http.HandlerFunc(s.UploadStatusHandler))
+	_ = json.Unmarshal(rr.Body.Bytes(), &chunks)
+	if len(chunks) != 1 || chunks[0].Offset != 50 || chunks[0].Size != 50 {
+		t.Errorf("Got %v expected a single chunk at 50", rr.Body)
+	}
+	rr = uploadChunk(form1, transferID, 0, fileBytes[:50])
+	if rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	password := RandomString(10)
+	form1.Set("password", password)
+	rr = postRequest(form1, http.HandlerFunc(s.UploadCompleteHandler))
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// download assembled file
+	_, _, user2Ws, _ := connectWSS(user2, form2)
+	message := readSocketMessage(user2Ws)
+	user2Ws.Close()
+	if message.Download == nil || message.Download.Size != fileSize {
+		t.Fatalf("expected download message got %v", message)
+	}
+
+	form2.Set("UUID_key", user2.UUIDKey)
+	form2.Set("file_path", message.Download.FilePath)
+	rr = postRequest(form2, http.HandlerFunc(s.DownloadHandler))
+	if rr.Body.String() != string(fileBytes) {
+		t.Errorf("Got %v expected %v", rr.Body.String(), string(fileBytes))
+	}
+
+	form2.Set("hash", HashWithBytes(rr.Body.Bytes()))
+	rr = postRequest(form2, http.HandlerFunc(s.CompletedDownloadHandler))
+	if rr.Body.String() != password {
+		t.Errorf("Got %v expected %v", rr.Body.String(), password)
+	}
+}
+
+func TestChunkedUploadMissingLastChunk(t *testing.T) {
+	user1, form1 := genUser()
+	user2, _ := genUser()
+
+	fileBytes := []byte(RandomString(100))
+	initUploadR := initUpload(form1, user1, user2, len(fileBytes))
+	transferID := initUploadR.Header().Get("Transfer-ID")
+	if initUploadR.Code != 200 || transferID == "" {
+		t.Fatalf("Got %v (%v) expected %v", initUploadR.Code, initUploadR.Body, 200)
+	}
+	if rr := uploadChunk(form1, transferID, 0, fileBytes[:60]); rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// the chunks have to add up to the size the upload was started with
+	form1.Set("transfer_id", transferID)
+	form1.Set("filename", "foo.bar")
+	rr := postRequest(form1, http.HandlerFunc(s.UploadCompleteHandler))
+	if e := readError(rr); rr.Code != 409 || e.Code != ErrIncompleteUpload.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 409)
+	}
+	if rr = uploadChunk(form1, transferID, 60, fileBytes[60:]); rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	if rr = postRequest(form1, http.HandlerFunc(s.UploadCompleteHandler)); rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+}
+
+func TestBundleTransfer(t *testing.T) {
+	user1, form1 := genUser()
+	user2, form2 := genUser()
+
+	contents := map[string]string{
+		"a.txt":        RandomString(10),
+		"folder/b.txt": RandomString(20),
+	}
+	manifest, _ := json.Marshal([]TransferFile{
+		{Path: "a.txt", Size: 10, Hash: HashWithBytes([]byte(contents["a.txt"]))},
+		{Path: "folder/b.txt", Size: 20, Hash: HashWithBytes([]byte(contents["folder/b.txt"]))},
+	})
+
+	form1.Set("manifest", string(manifest))
+	initUploadR := initUpload(form1, user1, user2, 0)
+	form1.Del("manifest")
+	transferID := initUploadR.Header().Get("Transfer-ID")
+	if initUploadR.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", initUploadR.Code, initUploadR.Body, 200)
+	}
+
+	// file that does not match manifest
+	rr := uploadBundleFile(form1, transferID, "a.txt", RandomString(10))
+	if rr.Code != 400 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+
+	rr = uploadBundleFile(form1, transferID, "a.txt", contents["a.txt"])
+	if rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// can't complete until every file has been uploaded
+	form1.Set("transfer_id", transferID)
+	rr = postRequest(form1, http.HandlerFunc(s.UploadCompleteHandler))
+	if rr.Code != 409 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 409)
+	}
+
+	rr = uploadBundleFile(form1, transferID, "folder/b.txt", contents["folder/b.txt"])
+	if rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	password := RandomString(10)
+	form1.Set("password", password)
+	rr = postRequest(form1, http.HandlerFunc(s.UploadCompleteHandler))
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	_, _, user2Ws, _ := connectWSS(user2, form2)
+	message := readSocketMessage(user2Ws)
+	user2Ws.Close()
+	if message.Download == nil || len(message.Download.Files) != 2 || message.Download.Size != 30 {
+		t.Fatalf("expected bundle download message got %v", message.Download)
+	}
+
+	// download a single file
+	form2.Set("UUID_key", user2.UUIDKey)
+	form2.Set("file_path", message.Download.FilePath)
+	form2.Set("file", "folder/b.txt")
+	rr = postRequest(form2, http.HandlerFunc(s.DownloadHandler))
+	if rr.Body.String() != contents["folder/b.txt"] {
+		t.Errorf("Got %v expected %v", rr.Body.String(), contents["folder/b.txt"])
+	}
+
+	// download whole bundle as tar
+	form2.Del("file")
+	rr = postRequest(form2, http.HandlerFunc(s.DownloadHandler))
+	tr := tar.NewReader(rr.Body)
+	for i := 0; i < 2; i++ {
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		if string(b) != contents[header.Name] {
+			t.Errorf("Got %v expected %v for %v", string(b), contents[header.Name], header.Name)
+		}
+	}
+
+	form2.Set("hash", ManifestHash(message.Download.Files))
+	rr = postRequest(form2, http.HandlerFunc(s.CompletedDownloadHandler))
+	if rr.Body.String() != password {
+		t.Errorf("Got %v expected %v", rr.Body.String(), password)
+	}
+}
+
+func TestGroupTransfer(t *testing.T) {
+	user1, form1 := genUser()
+	user2, form2 := genUser()
+	user3, form3 := genUser()
+
+	fileSize := 100
+	fileBytes := []byte(RandomString(fileSize))
+
+	form1.Set("UUID_key", user1.UUIDKey)
+	form1.Set("filesize", strconv.Itoa(fileSize))
+	form1.Set("code", user2.Code)
+	form1.Add("code", user3.Code)
+	initUploadR := postRequest(form1, http.HandlerFunc(s.InitUploadHandler))
+	var publicKeys map[string]string
+	_ = json.Unmarshal(initUploadR.Body.Bytes(), &publicKeys)
+	if initUploadR.Code != 200 || publicKeys[user2.Code] != testB64PubKey || publicKeys[user3.Code] != testB64PubKey {
+		t.Fatalf("Got %v (%v) expected public keys of both friends", initUploadR.Code, initUploadR.Body)
+	}
+	transferID := initUploadR.Header().Get("Transfer-ID")
+
+	rr := uploadChunk(form1, transferID, 0, fileBytes)
+	if rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	passwords := map[string]string{user2.Code: RandomString(10), user3.Code: RandomString(10)}
+	form1.Set("transfer_id", transferID)
+	form1.Set("filename", "foo.bar")
+	form1.Set(groupPasswordPrefix+user2.Code, passwords[user2.Code])
+	form1.Set(groupPasswordPrefix+user3.Code, passwords[user3.Code])
+	rr = postRequest(form1, http.HandlerFunc(s.UploadCompleteHandler))
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	var filePath string
+	for _, friend := range []struct {
+		user User
+		form url.Values
+	}{{user2, form2}, {user3, form3}} {
+		_, _, ws, _ := connectWSS(friend.user, friend.form)
+		message := readSocketMessage(ws)
+		ws.Close()
+		if message.Download == nil {
+			t.Fatalf("expected download message got %v", message)
+		}
+		filePath = message.Download.FilePath
+
+		friend.form.Set("UUID_key", friend.user.UUIDKey)
+		friend.form.Set("file_path", filePath)
+		rr = postRequest(friend.form, http.HandlerFunc(s.DownloadHandler))
+		if rr.Body.String() != string(fileBytes) {
+			t.Errorf("Got %v expected %v", rr.Body.String(), string(fileBytes))
+		}
+
+		friend.form.Set("hash", HashWithBytes(rr.Body.Bytes()))
+		rr = postRequest(friend.form, http.HandlerFunc(s.CompletedDownloadHandler))
+		if rr.Body.String() != passwords[friend.user.Code] {
+			t.Errorf("Got %v expected %v", rr.Body.String(), passwords[friend.user.Code])
+		}
+
+		// file should only be deleted after the last friend has downloaded it
+		_, err := os.Stat(fileStoreDirectory + filePath)
+		if friend.user.Code == user2.Code && err != nil {
+			t.Errorf("file at path: '%v' should not have been deleted", filePath)
+		} else if friend.user.Code == user3.Code && err == nil {
+			t.Errorf("file at path: '%v' should have been deleted", filePath)
+		}
+	}
+}
+
+func TestUploadLargerThanInit(t *testing.T) {
+	user1, form1 := genUser()
+	user2, _ := genUser()
+
+	f, _ := os.Create("foo.bar")
+	defer f.Close()
+	defer os.Remove("foo.bar")
+	_ = f.Truncate(int64(1000))
+
+	initUploadR := initUpload(form1, user1, user2, 999)
+	rr := uploadFile(f, initUploadR.Header().Get("Set-Cookie"), RandomString(10))
+	if rr.Code != 413 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 413)
+	}
+}
+
 func TestInvalidUploadFileSizeVariable(t *testing.T) {
 	user1, form1 := genUser()
 	form1.Set("UUID_key", user1.UUIDKey)
 	rr := postRequest(form1, http.HandlerFunc(s.InitUploadHandler))
-	if rr.Code != 401 { // TODO test body
-		t.Errorf("expected: %d got %d - %s", 401, rr.Code, rr.Body.String())
+	if e := readError(rr); rr.Code != ErrInvalidFilesize.Status || e.Code != ErrInvalidFilesize.Code {
+		t.Errorf("expected: %d %s got %d - %s", ErrInvalidFilesize.Status, ErrInvalidFilesize.Code, rr.Code, rr.Body.String())
 	}
 }
 
@@ -160,8 +501,8 @@ func TestUploadToNonExistingFriend(t *testing.T) {
 	form1.Set("filesize", strconv.Itoa(123))
 	form1.Set("code", RandomString(codeLen))
 	rr := postRequest(form1, http.HandlerFunc(s.InitUploadHandler))
-	if rr.Code != 402 { // TODO test body
-		t.Errorf("expected: %d got %d - %s", 402, rr.Code, rr.Body.String())
+	if e := readError(rr); rr.Code != ErrFriendNotFound.Status || e.Code != ErrFriendNotFound.Code {
+		t.Errorf("expected: %d %s got %d - %s", ErrFriendNotFound.Status, ErrFriendNotFound.Code, rr.Code, rr.Body.String())
 	}
 }
 
@@ -171,8 +512,8 @@ func TestInvalidSendUploadToSelf(t *testing.T) {
 	form1.Set("filesize", strconv.Itoa(123))
 	form1.Set("code", user1.Code)
 	rr := postRequest(form1, http.HandlerFunc(s.InitUploadHandler))
-	if rr.Code != 403 { // TODO test body
-		t.Errorf("expected: %d got %d - %s", 403, rr.Code, rr.Body.String())
+	if e := readError(rr); rr.Code != ErrSendToSelf.Status || e.Code != ErrSendToSelf.Code {
+		t.Errorf("expected: %d %s got %d - %s", ErrSendToSelf.Status, ErrSendToSelf.Code, rr.Code, rr.Body.String())
 	}
 }
 
@@ -187,8 +528,8 @@ func TestTooLargeUpload(t *testing.T) {
 	form1.Set("filesize", strconv.Itoa(freeFileUploadBytes+1))
 	form1.Set("code", user2.Code)
 	rr := postRequest(form1, http.HandlerFunc(s.InitUploadHandler))
-	if rr.Code != 405 { // TODO test body
-		t.Errorf("expected: %d got %d - %s", 405, rr.Code, rr.Body.String())
+	if e := readError(rr); rr.Code != ErrFileTooLarge.Status || e.Code != ErrFileTooLarge.Code {
+		t.Errorf("expected: %d %s got %d - %s", ErrFileTooLarge.Status, ErrFileTooLarge.Code, rr.Code, rr.Body.String())
 	}
 }
 
@@ -318,26 +659,41 @@ var invalidHandlerMethods = []struct {
 }{
 	{http.HandlerFunc(s.CompletedDownloadHandler), "GET"},
 	{http.HandlerFunc(s.UploadHandler), "GET"},
+	{http.HandlerFunc(s.UploadFileHandler), "GET"},
+	{http.HandlerFunc(s.UploadChunkHandler), "GET"},
+	{http.HandlerFunc(s.UploadStatusHandler), "GET"},
+	{http.HandlerFunc(s.UploadCompleteHandler), "GET"},
 	{http.HandlerFunc(s.InitUploadHandler), "GET"},
 	{http.HandlerFunc(s.DownloadHandler), "GET"},
 	{http.HandlerFunc(s.CreateCodeHandler), "GET"},
+	{http.HandlerFunc(s.TokenHandler), "GET"},
+	{http.HandlerFunc(s.ChallengeHandler), "GET"},
+	{http.HandlerFunc(s.RecoverHandler), "GET"},
+	{http.HandlerFunc(s.V1CreateCodeHandler), "GET"},
+	{http.HandlerFunc(s.V1InitUploadHandler), "GET"},
+	{http.HandlerFunc(s.V1TogglePermCodeHandler), "GET"},
 	{http.HandlerFunc(s.RegisterCreditHandler), "GET"},
 	{http.HandlerFunc(s.CustomCodeHandler), "GET"},
 	{http.HandlerFunc(s.TogglePermCodeHandler), "GET"},
+	{http.HandlerFunc(s.RegisterDeviceHandler), "GET"},
+	{http.HandlerFunc(s.DevicesHandler), "GET"},
+	{http.HandlerFunc(s.RemoveDeviceHandler), "GET"},
+	{http.HandlerFunc(s.V1RegisterDeviceHandler), "GET"},
 	{http.HandlerFunc(s.LiveHandler), "POST"},
+	{http.HandlerFunc(s.OpenAPIHandler), "POST"},
 	{http.HandlerFunc(s.WSHandler), "POST"},
 }
 
 // request handlers with incorrect methods
 func TestInvalidHandlerMethods(t *testing.T) {
 	for i, tt := range invalidHandlerMethods {
-		t.Run(string(i), func(t *testing.T) {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
 			req, _ := http.NewRequest(tt.invalidMethod, "", nil)
 
 			rr := httptest.NewRecorder()
 			tt.handler.ServeHTTP(rr, req)
-			if rr.Code != 400 {
-				t.Errorf("Should have responded with error code %d not %d", 400, rr.Code)
+			if e := readError(rr); rr.Code != 405 || e.Code != ErrInvalidMethod.Code {
+				t.Errorf("Should have responded with error %d %v not %d %v", 405, ErrInvalidMethod.Code, rr.Code, e.Code)
 			}
 		})
 	}
@@ -345,19 +701,28 @@ func TestInvalidHandlerMethods(t *testing.T) {
 
 var userLoginDetailsHandlers = []struct {
 	handler http.HandlerFunc
+	err     APIError
 }{
-	{http.HandlerFunc(s.CompletedDownloadHandler)},
-	{http.HandlerFunc(s.InitUploadHandler)},
-	{http.HandlerFunc(s.DownloadHandler)},
-	{http.HandlerFunc(s.RegisterCreditHandler)},
-	{http.HandlerFunc(s.CustomCodeHandler)},
-	{http.HandlerFunc(s.TogglePermCodeHandler)},
-	{http.HandlerFunc(s.WSHandler)},
+	{http.HandlerFunc(s.CompletedDownloadHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.InitUploadHandler), ErrInvalidCredentials},
+	// not a multipart body
+	{http.HandlerFunc(s.UploadFileHandler), ErrInvalidForm},
+	{http.HandlerFunc(s.UploadChunkHandler), ErrInvalidForm},
+	{http.HandlerFunc(s.UploadStatusHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.UploadCompleteHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.DownloadHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.RegisterCreditHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.TokenHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.CustomCodeHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.TogglePermCodeHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.RegisterDeviceHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.DevicesHandler), ErrInvalidCredentials},
+	{http.HandlerFunc(s.RemoveDeviceHandler), ErrInvalidCredentials},
 }
 
 func TestInvalidIsValidUsers(t *testing.T) {
 	for i, tt := range userLoginDetailsHandlers {
-		t.Run(string(i), func(t *testing.T) {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
 
 			invalidUserLogin := url.Values{}
 			invalidUserLogin.Set("UUID", "")
@@ -367,8 +732,8 @@ func TestInvalidIsValidUsers(t *testing.T) {
 
 			rr := httptest.NewRecorder()
 			tt.handler.ServeHTTP(rr, req)
-			if rr.Code != 400 {
-				t.Errorf("Should have responded with error code %d not %d", 400, rr.Code)
+			if e := readError(rr); rr.Code != tt.err.Status || e.Code != tt.err.Code {
+				t.Errorf("Should have responded with error %d %v not %d %v", tt.err.Status, tt.err.Code, rr.Code, e.Code)
 			}
 		})
 	}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPingSecs      = 30
+	defaultPongWaitSecs  = 60
+	defaultWriteWaitSecs = 10
+)
+
+// Heartbeat configures how web socket connections that have silently gone away are detected
+type Heartbeat struct {
+	// how often the server pings the client
+	PingInterval time.Duration
+	// how long to wait for a pong or any other message from the client before the connection is considered dead
+	PongWait time.Duration
+	// how long a single write to the client may take
+	WriteWait time.Duration
+}
+
+// heartbeat is used by every new web socket connection
+var heartbeat = Heartbeat{
+	PingInterval: time.Second * defaultPingSecs,
+	PongWait:     time.Second * defaultPongWaitSecs,
+	WriteWait:    time.Second * defaultWriteWaitSecs,
+}
+
+// NewHeartbeat creates a Heartbeat from the ws_ping_secs, ws_pong_wait_secs and ws_write_wait_secs environment
+// variables. The pong wait is always longer than the ping interval so a healthy client is never disconnected.
+func NewHeartbeat() Heartbeat {
+	hb := Heartbeat{
+		PingInterval: envSeconds("ws_ping_secs", defaultPingSecs),
+		PongWait:     envSeconds("ws_pong_wait_secs", defaultPongWaitSecs),
+		WriteWait:    envSeconds("ws_write_wait_secs", defaultWriteWaitSecs),
+	}
+	if hb.PongWait <= hb.PingInterval {
+		hb.PongWait = hb.PingInterval + hb.WriteWait
+	}
+	return hb
+}
+
+// envSeconds reads a positive number of seconds from the environment variable name
+func envSeconds(name string, fallback int) time.Duration {
+	return time.Second * time.Duration(envInt(name, fallback))
+}
+
+// envInt reads a positive integer from the environment variable name
+func envInt(name string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+// ExtendReadDeadline gives the client another PongWait to send a message or pong. It is called whenever anything is
+// received from the client.
+func (funnel *Funnel) ExtendReadDeadline() error {
+	return funnel.conn.SetReadDeadline(time.Now().Add(funnel.heartbeat.PongWait))
+}
+
+// Ping sends a ping to the client which replies with a pong
+func (funnel *Funnel) Ping() error {
+	funnel.Lock()
+	defer funnel.Unlock()
+	return funnel.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(funnel.heartbeat.WriteWait))
+}
+
+// KeepAlive pings the client every PingInterval until stop is closed. If a ping fails the connection is closed which
+// ends the read loop of the socket.
+func (funnel *Funnel) KeepAlive(stop <-chan struct{}) {
+	ticker := time.NewTicker(funnel.heartbeat.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := funnel.Ping(); err != nil {
+				funnel.Close()
+				return
+			}
+		}
+	}
+}
+
+// Close closes the connection of the funnel
+func (funnel *Funnel) Close() {
+	_ = funnel.conn.Close()
+}
@@ -5,6 +5,12 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/Pallinder/go-randomdata"
@@ -80,10 +86,38 @@ func postRequest(form url.Values, handler http.HandlerFunc) *httptest.ResponseRe
 	req, _ := http.NewRequest("POST", "", strings.NewReader(form.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, req)
+	s.AuthHandler(handler).ServeHTTP(rr, req)
 	return rr
 }
 
+func postRequestWithHeader(form url.Values, header http.Header, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "", strings.NewReader(form.Encode()))
+	req.Header = header
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	s.AuthHandler(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+// postJSON posts v as JSON to handler through AuthHandler
+func postJSON(v interface{}, header http.Header, handler http.Handler) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(v)
+	req, _ := http.NewRequest("POST", "", bytes.NewReader(b))
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	s.AuthHandler(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+// readError decodes the APIError written by WriteError
+func readError(rr *httptest.ResponseRecorder) (e APIError) {
+	_ = json.Unmarshal(rr.Body.Bytes(), &e)
+	return
+}
+
 func genUser() (user User, form url.Values) {
 	form = url.Values{}
 	UUID, _ := uuid.NewRandom()
@@ -97,6 +131,44 @@ func genUser() (user User, form url.Values) {
 	return
 }
 
+// genKeyUser creates a user with a newly generated RSA key pair
+func genKeyUser(t *testing.T) (privateKey *rsa.PrivateKey, user User, form url.Values) {
+	privateKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+
+	form = url.Values{}
+	UUID, _ := uuid.NewRandom()
+	form.Set("UUID", UUID.String())
+	form.Set("public_key", base64.StdEncoding.EncodeToString(der))
+	rr := postRequest(form, http.HandlerFunc(s.CreateCodeHandler))
+	if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(10))
+	return
+}
+
+func getChallenge(t *testing.T, UUID string) string {
+	rr := postRequest(url.Values{"UUID": {UUID}}, http.HandlerFunc(s.ChallengeHandler))
+	var challenge struct {
+		Challenge string `json:"challenge"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &challenge)
+	if rr.Code != 200 || challenge.Challenge == "" {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	return challenge.Challenge
+}
+
+func signChallenge(privateKey *rsa.PrivateKey, challenge string) string {
+	hashed := sha256.Sum256([]byte(challenge))
+	sig, _ := rsa.SignPKCS1v15(crand.Reader, privateKey, crypto.SHA256, hashed[:])
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
 func genCreditUser(credit float64) (user User, form url.Values) {
 	user, form = genUser()
 
@@ -128,7 +200,7 @@ func readSocketMessage(ws *websocket.Conn) (message SocketMessage) {
 }
 
 func connectWSSHeader(wsheader http.Header) (*httptest.Server, *http.Response, *websocket.Conn, error) {
-	server := httptest.NewServer(http.HandlerFunc(s.WSHandler))
+	server := httptest.NewServer(s.AuthHandler(http.HandlerFunc(s.WSHandler)))
 	ws, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), wsheader)
 	Handle(err)
 	if err == nil {
@@ -207,3 +279,39 @@ func uploadFile(f *os.File, initCookie string, pass string) *httptest.ResponseRe
 	http.HandlerFunc(s.UploadHandler).ServeHTTP(uploadR, req)
 	return uploadR
 }
+
+func uploadChunk(form url.Values, transferID string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for key := range form {
+		_ = writer.WriteField(key, form.Get(key))
+	}
+	_ = writer.WriteField("transfer_id", transferID)
+	_ = writer.WriteField("offset", strconv.Itoa(offset))
+	part, _ := writer.CreateFormFile("chunk", "chunk")
+	_, _ = part.Write(chunk)
+	_ = writer.Close()
+	req, _ := http.NewRequest("POST", "", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.UploadChunkHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func uploadBundleFile(form url.Values, transferID string, path string, contents string) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for key := range form {
+		_ = writer.WriteField(key, form.Get(key))
+	}
+	_ = writer.WriteField("transfer_id", transferID)
+	_ = writer.WriteField("path", path)
+	part, _ := writer.CreateFormFile("file", path)
+	_, _ = part.Write([]byte(contents))
+	_ = writer.Close()
+	req, _ := http.NewRequest("POST", "", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.UploadFileHandler).ServeHTTP(rr, req)
+	return rr
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/go-sql-driver/mysql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryDays  = 30
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+
+	historySent     = "sent"
+	historyReceived = "received"
+)
+
+// historyRetention is how long finished transfers are kept for the history of users. It is set in days by
+// history_days.
+func historyRetention() time.Duration {
+	return time.Hour * 24 * time.Duration(envInt("history_days", defaultHistoryDays))
+}
+
+// HistoryRequest fetches a page of the transfer history of a user. Before is the Next of the previous page.
+type HistoryRequest struct {
+	Limit  int   `json:"limit,omitempty"`
+	Before int64 `json:"before,omitempty"`
+}
+
+// TransferEventsRequest fetches every transition of the transfer with TransferID
+type TransferEventsRequest struct {
+	TransferID int64 `json:"transfer_id"`
+}
+
+// TransferReceipt is a transfer that a user sent or received
+type TransferReceipt struct {
+	TransferID int64         `json:"transfer_id"`
+	Direction  string        `json:"direction"`
+	Code       string        `json:"code"`
+	Size       int           `json:"file_size"`
+	Hash       string        `json:"hash,omitempty"`
+	State      TransferState `json:"state"`
+	Created    time.Time     `json:"created"`
+	Finished   *time.Time    `json:"finished,omitempty"`
+}
+
+// TransferHistory is a page of transfers from newest to oldest. Next is set if there are older transfers.
+type TransferHistory struct {
+	Transfers []TransferReceipt `json:"transfers"`
+	Next      int64             `json:"next,omitempty"`
+}
+
+// GetTransferHistory fetches the transfers sent and received by user within historyRetention. Code is the code of
+// the friend at the time of the transfer.
+func GetTransferHistory(db *sql.DB, user User, req HistoryRequest) (TransferHistory, error) {
+	history := TransferHistory{Transfers: []TransferReceipt{}}
+	UUID := Hash(user.UUID)
+
+	// fetch one more than the limit to know if there is another page
+	rows, err := db.Query(`
+	SELECT id, from_UUID, IFNULL(from_code, ''), IFNULL(to_code, ''), size, IFNULL(file_hash, ''), state,
+		created_dttm, finished_dttm
+	FROM transfer
+	WHERE (from_UUID = ? OR to_UUID = ?)
+	AND (? = 0 OR id < ?)
+	AND created_dttm > ?
+	ORDER BY id DESC
+	LIMIT ?`, UUID, UUID, req.Before, req.Before, time.Now().Add(-historyRetention()), req.Limit+1)
+	if err != nil {
+		return history, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			receipt  TransferReceipt
+			fromUUID string
+			fromCode string
+			toCode   string
+			finished mysql.NullTime
+		)
+		if err := rows.Scan(&receipt.TransferID, &fromUUID, &fromCode, &toCode, &receipt.Size, &receipt.Hash,
+			&receipt.State, &receipt.Created, &finished); err != nil {
+			return history, err
+		}
+		if len(history.Transfers) == req.Limit {
+			history.Next = history.Transfers[req.Limit-1].TransferID
+			break
+		}
+
+		receipt.Direction, receipt.Code = historyReceived, fromCode
+		if fromUUID == UUID {
+			receipt.Direction, receipt.Code = historySent, toCode
+		}
+		if finished.Valid {
+			receipt.Finished = &finished.Time
+		}
+		history.Transfers = append(history.Transfers, receipt)
+	}
+	return history, rows.Err()
+}
+
+// cleanTransferHistory deletes finished transfers that are older than historyRetention
+func cleanTransferHistory(db *sql.DB) {
+	rows, err := db.Query(`
+	SELECT id
+	FROM transfer
+	WHERE finished_dttm IS NOT NULL
+	AND created_dttm < ?`, time.Now().Add(-historyRetention()))
+	if err != nil {
+		Handle(err)
+		return
+	}
+	var IDs []int64
+	for rows.Next() {
+		var ID int64
+		Handle(rows.Scan(&ID))
+		IDs = append(IDs, ID)
+	}
+	Handle(rows.Close())
+
+	for _, ID := range IDs {
+		for _, table := range []string{"transfer_event", "transfer_file", "transfer_device"} {
+			_, err := db.Exec(`DELETE FROM `+table+` WHERE transfer_id = ?`, ID)
+			Handle(err)
+		}
+		_, err := db.Exec(`DELETE FROM transfer WHERE id = ?`, ID)
+		Handle(err)
+	}
+	if len(IDs) > 0 {
+		log.Println("Deleted the history of " + strconv.Itoa(len(IDs)) + " transfers")
+	}
+}
+
+// TransferHistory returns a page of the transfers that user has sent and received
+func (s *Server) TransferHistory(user User, req HistoryRequest) (TransferHistory, error) {
+	if req.Limit <= 0 {
+		req.Limit = defaultHistoryLimit
+	} else if req.Limit > maxHistoryLimit {
+		req.Limit = maxHistoryLimit
+	}
+	history, err := GetTransferHistory(s.db, user, req)
+	if err != nil {
+		Handle(err)
+		return history, ErrInternal.WithMessage("Failed to fetch transfers")
+	}
+	return history, nil
+}
+
+// TransfersHandler is the form handler for TransferHistory
+func (s *Server) TransfersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.Form.Get("limit"))
+	before, _ := strconv.ParseInt(r.Form.Get("before"), 10, 64)
+	history, err := s.TransferHistory(user, HistoryRequest{Limit: limit, Before: before})
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	Handle(WriteJSON(w, history))
+}
+
+// V1TransfersHandler is the JSON handler for TransferHistory
+func (s *Server) V1TransfersHandler(w http.ResponseWriter, r *http.Request) {
+	var req HistoryRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	history, err := s.TransferHistory(user, req)
+	writeJSONResult(w, r, history, err)
+}
+
+// TransferEvents returns the transitions of a transfer that user sent or received so that the lifecycle of the
+// transfer can be shown alongside its TransferReceipt
+func (s *Server) TransferEvents(user User, req TransferEventsRequest) ([]TransferEvent, error) {
+	var ID int64
+	err := s.db.QueryRow(`
+	SELECT id
+	FROM transfer
+	WHERE id = ?
+	AND (from_UUID = ? OR to_UUID = ?)`, req.TransferID, Hash(user.UUID), Hash(user.UUID)).Scan(&ID)
+	if err == sql.ErrNoRows {
+		return nil, ErrTransferNotFound
+	} else if err != nil {
+		Handle(err)
+		return nil, ErrInternal.WithMessage("Failed to fetch transfer")
+	}
+
+	events, err := GetTransferEvents(s.db, ID)
+	if err != nil {
+		Handle(err)
+		return nil, ErrInternal.WithMessage("Failed to fetch transfer events")
+	}
+	return events, nil
+}
+
+// TransferEventsHandler is the form handler for TransferEvents
+func (s *Server) TransferEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	transferID, _ := strconv.ParseInt(r.Form.Get("transfer_id"), 10, 64)
+	events, err := s.TransferEvents(user, TransferEventsRequest{TransferID: transferID})
+	if err != nil {
+		WriteError(w, r, AsAPIError(err))
+		return
+	}
+	Handle(WriteJSON(w, events))
+}
+
+// V1TransferEventsHandler is the JSON handler for TransferEvents
+func (s *Server) V1TransferEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var req TransferEventsRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	events, err := s.TransferEvents(user, req)
+	writeJSONResult(w, r, events, err)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func readHistory(t *testing.T, rr *httptest.ResponseRecorder) TransferHistory {
+	var history TransferHistory
+	if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
+
+func TestTransferHistory(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+
+	fileBytes := []byte(RandomString(100))
+	sent := sendV1(t, user1, header1, InitUploadRequest{Codes: []string{user2.Code}}, fileBytes)
+	rr := postJSON(CancelRequest{TransferID: sent.TransferID}, header1, http.HandlerFunc(s.V1CancelHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+	rr = postJSON(InitUploadRequest{Filesize: 10, Codes: []string{user1.Code}}, header2,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var received InitUploadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &received); rr.Code != 200 || err != nil {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// newest first a page at a time
+	rr = postJSON(HistoryRequest{Limit: 1}, header1, http.HandlerFunc(s.V1TransfersHandler))
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	history := readHistory(t, rr)
+	if len(history.Transfers) != 1 || history.Next != received.TransferID {
+		t.Fatalf("got %+v", history)
+	}
+	receipt := history.Transfers[0]
+	if receipt.TransferID != received.TransferID || receipt.Direction != historyReceived || receipt.Code != user2.Code ||
+		receipt.Size != 10 || receipt.State != StateInitialised || receipt.Finished != nil || receipt.Created.IsZero() {
+		t.Errorf("got %+v", receipt)
+	}
+
+	rr = postJSON(HistoryRequest{Limit: 1, Before: history.Next}, header1, http.HandlerFunc(s.V1TransfersHandler))
+	history = readHistory(t, rr)
+	if len(history.Transfers) != 1 || history.Next != 0 {
+		t.Fatalf("got %+v", history)
+	}
+	receipt = history.Transfers[0]
+	if receipt.TransferID != sent.TransferID || receipt.Direction != historySent || receipt.Code != user2.Code ||
+		receipt.Hash != HashWithBytes(fileBytes) || receipt.State != StateCancelled || receipt.Finished == nil {
+		t.Errorf("got %+v", receipt)
+	}
+
+	// the friend sees the same transfers the other way round
+	rr = postRequestWithHeader(url.Values{}, header2, http.HandlerFunc(s.TransfersHandler))
+	history = readHistory(t, rr)
+	if len(history.Transfers) != 2 || history.Transfers[0].Direction != historySent ||
+		history.Transfers[1].Direction != historyReceived || history.Transfers[1].Code != user1.Code {
+		t.Errorf("got %+v", history)
+	}
+
+	_, header3 := v1User(t)
+	rr = postJSON(HistoryRequest{}, header3, http.HandlerFunc(s.V1TransfersHandler))
+	if rr.Code != 200 || rr.Body.String() != `{"transfers":[]}` {
+		t.Errorf("Got %v (%v) expected no transfers", rr.Code, rr.Body)
+	}
+}
+
+func TestCleanTransferHistory(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, _ := v1User(t)
+
+	sent := sendV1(t, user1, header1, InitUploadRequest{Codes: []string{user2.Code}},
+		[]byte(RandomString(100)))
+	rr := postJSON(CancelRequest{TransferID: sent.TransferID}, header1, http.HandlerFunc(s.V1CancelHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+
+	// finished transfers are only kept for historyRetention
+	_, err := s.db.Exec(`
+	UPDATE transfer
+	SET created_dttm = ?
+	WHERE id = ?`, time.Now().Add(-historyRetention()-time.Hour), sent.TransferID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanTransferHistory(s.db)
+
+	rr = postJSON(HistoryRequest{}, header1, http.HandlerFunc(s.V1TransfersHandler))
+	if history := readHistory(t, rr); len(history.Transfers) != 0 {
+		t.Errorf("got %+v", history)
+	}
+	if events, _ := GetTransferEvents(s.db, sent.TransferID); len(events) != 0 {
+		t.Errorf("got %+v", events)
+	}
+}
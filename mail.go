@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// mailer is the Mailer used for all emails. It is nil when no SMTP server has been configured.
+var mailer Mailer
+
+// NewMailer creates a SMTPMailer from the smtp_* environment variables or returns nil if smtp_addr is not set
+func NewMailer() Mailer {
+	if os.Getenv("smtp_addr") == "" {
+		return nil
+	}
+	return SMTPMailer{
+		Addr:     os.Getenv("smtp_addr"),
+		From:     os.Getenv("smtp_from"),
+		Username: os.Getenv("smtp_username"),
+		Password: os.Getenv("smtp_password"),
+	}
+}
+
+// SMTPMailer sends emails through the SMTP server at Addr (host:port)
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Send sends a plain text email to to
+func (m SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, strings.Split(m.Addr, ":")[0])
+	}
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body + "\r\n"
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(msg))
+}
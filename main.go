@@ -21,10 +21,14 @@ var lmt = tollbooth.NewLimiter(2, &limiter.ExpirableOptions{DefaultExpirationTTL
 	"RemoteAddr", "X-Forwarded-For", "X-Real-IP",
 })
 
+// recoveryLmt is a stricter limit for key recovery to slow down guessing recovery codes. It is applied by
+// RecoveryLimitHandler to both the IP of the client and the UUID being recovered.
+var recoveryLmt = tollbooth.NewLimiter(0.1, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour}).SetBurst(5)
+
 func ServerKeyHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Sec-Key") != os.Getenv("server_key") {
-			WriteError(w, r, 400, "Invalid form data")
+		if !IsValidServerKey(r.Header.Get("Sec-Key")) {
+			WriteError(w, r, ErrInvalidServerKey)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -57,6 +61,23 @@ func main() {
 
 	s := Server{db: db}
 
+	// where transfer files are stored
+	fileStorage = NewStorage()
+
+	// used to send key recovery codes
+	mailer = NewMailer()
+
+	// connects the web sockets of every instance
+	bus := NewBus()
+	if err := WSConns.SetBus(bus); err != nil {
+		log.Fatal(err)
+	}
+	defer bus.Close()
+
+	// how dead web sockets are detected
+	heartbeat = NewHeartbeat()
+	ResetConnected(s.db)
+
 	// clean up cron
 	c := cron.New()
 	err = c.AddFunc("@every 1m", s.CleanExpiredTransfers)
@@ -70,20 +91,42 @@ func main() {
 	// middleware
 	r.Use(tollbooth_chi.LimitHandler(lmt))
 	r.Use(sentryMiddleware.Handle)
-	mux := r
-	mux.Use(ServerKeyHandler)
+	s.Routes(r)
+
+	graceful.ListenAndServe(&http.Server{Addr: ":8080", Handler: r})
+}
+
+// Routes registers all handlers on r
+func (s *Server) Routes(r chi.Router) {
+	r.Use(ServerKeyHandler)
+	r.Use(s.AuthHandler)
 
 	// HANDLERS
-	mux.HandleFunc("/ws", s.WSHandler)
-	mux.HandleFunc("/code", s.CreateCodeHandler)
-	mux.HandleFunc("/init-upload", s.InitUploadHandler)
-	mux.HandleFunc("/upload", s.UploadHandler)
-	mux.HandleFunc("/download", s.DownloadHandler)
-	mux.HandleFunc("/completed-download", s.CompletedDownloadHandler)
-	mux.HandleFunc("/register", s.RegisterCreditHandler)
-	mux.HandleFunc("/toggle-perm-code", s.TogglePermCodeHandler)
-	mux.HandleFunc("/custom-code", s.CustomCodeHandler)
+	r.HandleFunc("/ws", s.WSHandler)
+	r.HandleFunc("/token", s.TokenHandler)
+	r.HandleFunc("/challenge", s.ChallengeHandler)
+	r.With(RecoveryLimitHandler).HandleFunc("/recover", s.RecoverHandler)
+	r.HandleFunc("/code", s.CreateCodeHandler)
+	r.HandleFunc("/init-upload", s.InitUploadHandler)
+	r.HandleFunc("/upload", s.UploadHandler)
+	r.HandleFunc("/upload-file", s.UploadFileHandler)
+	r.HandleFunc("/upload-chunk", s.UploadChunkHandler)
+	r.HandleFunc("/upload-status", s.UploadStatusHandler)
+	r.HandleFunc("/upload-complete", s.UploadCompleteHandler)
+	r.HandleFunc("/download", s.DownloadHandler)
+	r.HandleFunc("/completed-download", s.CompletedDownloadHandler)
+	r.HandleFunc("/register", s.RegisterCreditHandler)
+	r.HandleFunc("/toggle-perm-code", s.TogglePermCodeHandler)
+	r.HandleFunc("/custom-code", s.CustomCodeHandler)
+	r.HandleFunc("/register-device", s.RegisterDeviceHandler)
+	r.HandleFunc("/devices", s.DevicesHandler)
+	r.HandleFunc("/remove-device", s.RemoveDeviceHandler)
+	r.HandleFunc("/answer-offer", s.AnswerOfferHandler)
+	r.HandleFunc("/cancel", s.CancelHandler)
+	r.HandleFunc("/transfers", s.TransfersHandler)
+	r.HandleFunc("/transfer-events", s.TransferEventsHandler)
+	r.Mount("/v1", s.V1Router())
 
 	r.HandleFunc("/live", s.LiveHandler)
-	graceful.ListenAndServe(&http.Server{Addr: ":8080", Handler: r})
+	r.HandleFunc("/openapi.json", s.OpenAPIHandler)
 }
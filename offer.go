@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// offerLifeMins is how long a friend has to accept a transfer that needs their consent
+	offerLifeMins = 10
+	// maxFilenameLen is the longest filename that can be offered
+	maxFilenameLen = 255
+	// reasons an offer was not accepted
+	offerDeclined = "declined"
+	offerExpired  = "expired"
+)
+
+// TransferOffer asks a friend to accept a transfer before the sender uploads it
+type TransferOffer struct {
+	TransferID int64     `json:"transfer_id"`
+	Filename   string    `json:"filename"`
+	Size       int       `json:"file_size"`
+	From       string    `json:"from"`
+	Expiry     time.Time `json:"expiry"`
+}
+
+// OfferAnswer tells the sender how a friend answered a TransferOffer. TransferID is the transfer returned by
+// InitUpload and Reason is set if the offer was not accepted.
+type OfferAnswer struct {
+	TransferID int64  `json:"transfer_id"`
+	Code       string `json:"code"`
+	Accepted   bool   `json:"accepted"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// OfferResponse is the answer of a friend to a TransferOffer
+type OfferResponse struct {
+	TransferID int64 `json:"transfer_id"`
+	Accept     bool  `json:"accept"`
+}
+
+// Offer stores that the transfer needs the consent of the friend and sends them the offer
+func (transfer Transfer) Offer(db *sql.DB, filename string) error {
+	offer := TransferOffer{
+		TransferID: transfer.ID,
+		Filename:   filename,
+		Size:       transfer.Size,
+		From:       transfer.from.Code,
+		Expiry:     time.Now().Add(time.Minute * offerLifeMins),
+	}
+	err := UpdateErr(db.Exec(`
+	UPDATE transfer
+	SET needs_consent = 1, filename = ?, offer_expiry_dttm = ?
+	WHERE id = ?`, filename, offer.Expiry, transfer.ID))
+	if err != nil {
+		return err
+	}
+	WSConns.Write(db, SocketMessage{Offer: &offer}, transfer.to.UUID, true)
+	return nil
+}
+
+// GetOffer fetches an offer to user with ID that is still waiting for an answer
+func GetOffer(db *sql.DB, user User, ID int64) (transfer Transfer, ok bool) {
+	result := db.QueryRow(`
+	SELECT id, IFNULL(group_id, id), from_UUID, to_UUID, IFNULL(to_code, '')
+	FROM transfer
+	WHERE id = ?
+	AND to_UUID = ?
+	AND needs_consent = 1
+	AND accepted_dttm IS NULL
+	AND finished_dttm IS NULL
+	AND offer_expiry_dttm > NOW()`, ID, Hash(user.UUID))
+	err := result.Scan(&transfer.ID, &transfer.groupID, &transfer.from.UUID, &transfer.to.UUID, &transfer.to.Code)
+	return transfer, err == nil && transfer.ID > 0
+}
+
+// AwaitingConsent returns true if any friend in the group of the transfer has not yet answered its offer
+func (transfer Transfer) AwaitingConsent(db *sql.DB) bool {
+	var count int
+	Handle(db.QueryRow(`
+	SELECT COUNT(*)
+	FROM transfer
+	WHERE (id = ? OR group_id = ?)
+	AND needs_consent = 1
+	AND accepted_dttm IS NULL
+	AND finished_dttm IS NULL`, transfer.ID, transfer.ID).Scan(&count))
+	return count > 0
+}
+
+// Accepted stores that the friend accepted the offer and tells the sender
+func (transfer Transfer) Accepted(db *sql.DB) error {
+	err := UpdateErr(db.Exec(`
+	UPDATE transfer
+	SET accepted_dttm = NOW()
+	WHERE id = ?`, transfer.ID))
+	if err != nil {
+		return err
+	}
+	transfer.answered(db, OfferAnswer{Accepted: true})
+	return nil
+}
+
+// Rejected finishes a transfer whose offer was declined or expired and tells the sender why
+func (transfer Transfer) Rejected(db *sql.DB, reason string) error {
+	state := StateDeclined
+	if reason == offerExpired {
+		state = StateExpired
+	}
+	changed, err := transfer.Transition(db, state, "offer "+reason, func(tx *sql.Tx) error {
+		return UpdateErr(tx.Exec(`
+		UPDATE transfer
+		SET finished_dttm = NOW(), failed = 1
+		WHERE id = ?`, transfer.ID))
+	})
+	if err != nil || !changed {
+		return err
+	}
+	transfer.answered(db, OfferAnswer{Reason: reason})
+
+	message := DesktopMessage{Title: "Declined Transfer", Message: "Your friend declined your file!"}
+	if reason == offerExpired {
+		message = DesktopMessage{Title: "Expired Transfer!", Message: "Your friend did not accept your file in time!"}
+	}
+	WSConns.Write(db, SocketMessage{Message: &message}, transfer.from.UUID, true)
+	return nil
+}
+
+// answered removes the offer from the messages waiting for the friend and sends answer to the sender
+func (transfer Transfer) answered(db *sql.DB, answer OfferAnswer) {
+	Handle(DeletePendingMessage(db, transfer.to.UUID,
+		SocketMessage{Offer: &TransferOffer{TransferID: transfer.ID}}.DedupKey()))
+
+	answer.TransferID = transfer.groupID
+	answer.Code = transfer.to.Code
+	WSConns.Write(db, SocketMessage{Answer: &answer}, transfer.from.UUID, true)
+}
+
+// expireOffers rejects the offers that were not answered in time
+func expireOffers(db *sql.DB) {
+	rows, err := db.Query(`
+	SELECT id, IFNULL(group_id, id), from_UUID, to_UUID, IFNULL(to_code, '')
+	FROM transfer
+	WHERE needs_consent = 1
+	AND accepted_dttm IS NULL
+	AND finished_dttm IS NULL
+	AND offer_expiry_dttm < NOW()`)
+	if err != nil {
+		Handle(err)
+		return
+	}
+
+	var transfers []Transfer
+	for rows.Next() {
+		var transfer Transfer
+		Handle(rows.Scan(&transfer.ID, &transfer.groupID, &transfer.from.UUID, &transfer.to.UUID, &transfer.to.Code))
+		transfers = append(transfers, transfer)
+	}
+	Handle(rows.Close())
+
+	for _, transfer := range transfers {
+		Handle(transfer.Rejected(db, offerExpired))
+	}
+}
+
+// AnswerOffer accepts or declines an offer to user. The sender can upload the file once every friend has answered.
+func (s *Server) AnswerOffer(user User, req OfferResponse) error {
+	transfer, ok := GetOffer(s.db, user, req.TransferID)
+	if !ok {
+		return ErrOfferNotFound
+	}
+	var err error
+	if req.Accept {
+		err = transfer.Accepted(s.db)
+	} else {
+		err = transfer.Rejected(s.db, offerDeclined)
+	}
+	if err != nil {
+		Handle(err)
+		return ErrInternal.WithMessage("Failed to answer offer")
+	}
+	return nil
+}
+
+// AnswerOfferHandler is the form handler for AnswerOffer
+func (s *Server) AnswerOfferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+
+	// fetch form
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	transferID, _ := strconv.ParseInt(r.Form.Get("transfer_id"), 10, 64)
+	accept, _ := strconv.ParseBool(r.Form.Get("accept"))
+	if err := s.AnswerOffer(user, OfferResponse{TransferID: transferID, Accept: accept}); err != nil {
+		WriteError(w, r, AsAPIError(err))
+	}
+}
+
+// V1AnswerOfferHandler is the JSON handler for AnswerOffer
+func (s *Server) V1AnswerOfferHandler(w http.ResponseWriter, r *http.Request) {
+	var req OfferResponse
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+	writeJSONResult(w, r, nil, s.AnswerOffer(user, req))
+}
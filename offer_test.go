@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readSocketFrameType reads frames until one of type and decodes its payload into v
+func readSocketFrameType(t *testing.T, ws *websocket.Conn, typ string, v interface{}) {
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second * 2))
+	defer func() { _ = ws.SetReadDeadline(time.Time{}) }()
+	for {
+		frame := readSocketFrame(t, ws)
+		if frame.Type != typ {
+			continue
+		}
+		if err := json.Unmarshal(frame.Payload, v); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+}
+
+func initConsentUpload(t *testing.T, header http.Header, codes ...string) InitUploadResponse {
+	rr := postJSON(InitUploadRequest{Filesize: 100, Codes: codes, Consent: true, Filename: "dir/foo.bar"}, header,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var initUpload InitUploadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &initUpload); rr.Code != 200 || err != nil {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	return initUpload
+}
+
+func TestAcceptOffer(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	senderWs := connectDeviceWSS(header1)
+	defer senderWs.Close()
+	recipientWs := connectDeviceWSS(header2)
+	defer recipientWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	initUpload := initConsentUpload(t, header1, user2.Code)
+	var offer TransferOffer
+	readSocketFrameType(t, recipientWs, socketTypeTransferOffer, &offer)
+	if offer.Filename != "foo.bar" || offer.Size != 100 || offer.From != user1.Code || offer.Expiry.IsZero() {
+		t.Errorf("got %+v", offer)
+	}
+
+	// nothing can be uploaded until the friend accepts
+	credentials := url.Values{"UUID": {user1.UUID}, "UUID_key": {user1.UUIDKey}}
+	rr := uploadChunk(credentials, strconv.FormatInt(initUpload.TransferID, 10), 0, []byte(RandomString(10)))
+	if e := readError(rr); rr.Code != 409 || e.Code != ErrAwaitingConsent.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 409)
+	}
+
+	// only the friend can answer
+	rr = postJSON(OfferResponse{TransferID: offer.TransferID, Accept: true}, header1,
+		http.HandlerFunc(s.V1AnswerOfferHandler))
+	if e := readError(rr); rr.Code != 404 || e.Code != ErrOfferNotFound.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+	rr = postJSON(OfferResponse{TransferID: offer.TransferID, Accept: true}, header2,
+		http.HandlerFunc(s.V1AnswerOfferHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+
+	var answer OfferAnswer
+	readSocketFrameType(t, senderWs, socketTypeOfferAnswer, &answer)
+	if !answer.Accepted || answer.TransferID != initUpload.TransferID || answer.Code != user2.Code {
+		t.Errorf("got %+v", answer)
+	}
+
+	// the upload is allowed but no chunks have been sent
+	rr = postJSON(CompleteUploadRequest{TransferID: initUpload.TransferID, Filename: "foo.bar"}, header1,
+		http.HandlerFunc(s.V1UploadCompleteHandler))
+	if e := readError(rr); rr.Code != 409 || e.Code != ErrIncompleteUpload.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 409)
+	}
+}
+
+func TestDeclineOffer(t *testing.T) {
+	_, header1 := v1User(t)
+	user2, form2 := genUser()
+	senderWs := connectDeviceWSS(header1)
+	defer senderWs.Close()
+
+	// the offer waits for the friend to connect
+	consentUpload := initConsentUpload(t, header1, user2.Code)
+	messages, _ := PopPendingMessages(s.db, Hash(form2.Get("UUID")), "")
+	if len(messages) != 1 || messages[0].Offer == nil {
+		t.Fatalf("got %+v", messages)
+	}
+	form2.Set("UUID_key", user2.UUIDKey)
+	form2.Set("transfer_id", strconv.FormatInt(messages[0].Offer.TransferID, 10))
+	form2.Set("accept", "false")
+	if rr := postRequest(form2, http.HandlerFunc(s.AnswerOfferHandler)); rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	var answer OfferAnswer
+	readSocketFrameType(t, senderWs, socketTypeOfferAnswer, &answer)
+	if answer.Accepted || answer.Reason != offerDeclined || answer.Code != user2.Code {
+		t.Errorf("got %+v", answer)
+	}
+	var message DesktopMessage
+	readSocketFrameType(t, senderWs, socketTypeMessage, &message)
+	if message.Title != "Declined Transfer" {
+		t.Errorf("got %+v", message)
+	}
+
+	// a declined transfer can't be uploaded
+	rr := postJSON(CompleteUploadRequest{TransferID: consentUpload.TransferID, Filename: "foo.bar"}, header1,
+		http.HandlerFunc(s.V1UploadCompleteHandler))
+	if e := readError(rr); rr.Code != 404 || e.Code != ErrTransferNotFound.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+	if rr := postRequest(form2, http.HandlerFunc(s.AnswerOfferHandler)); rr.Code != 404 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+	credentials := url.Values{"UUID": {header1.Get("UUID")}, "UUID_key": {header1.Get("UUID-key")}}
+	rr = uploadChunk(credentials, strconv.FormatInt(consentUpload.TransferID, 10), 0, []byte(RandomString(100)))
+	if e := readError(rr); rr.Code != 404 || e.Code != ErrTransferNotFound.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+
+	// nor uploaded with the form once every friend has declined
+	user1, form1 := genUser()
+	form1.Set("consent", "true")
+	initUploadR := initUpload(form1, user1, user2, 10)
+	transferID := initUploadR.Header().Get("Transfer-ID")
+	if initUploadR.Code != 200 || transferID == "" {
+		t.Fatalf("Got %v (%v) expected %v", initUploadR.Code, initUploadR.Body, 200)
+	}
+	form2.Set("transfer_id", transferID)
+	if rr := postRequest(form2, http.HandlerFunc(s.AnswerOfferHandler)); rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	f, _ := os.Create("foo.bar")
+	defer f.Close()
+	defer os.Remove("foo.bar")
+	_, _ = f.WriteString(RandomString(10))
+	_, _ = f.Seek(0, 0)
+	rr = uploadFile(f, initUploadR.Header().Get("Set-Cookie"), "foo")
+	if e := readError(rr); rr.Code != 404 || e.Code != ErrTransferNotFound.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+}
+
+func TestExpireOffer(t *testing.T) {
+	_, header1 := v1User(t)
+	user2, form2 := genUser()
+	user3, header3 := v1User(t)
+	senderWs := connectDeviceWSS(header1)
+	defer senderWs.Close()
+
+	// a group can be uploaded once every friend has answered
+	initUpload := initConsentUpload(t, header1, user2.Code, user3.Code)
+	_, err := s.db.Exec(`
+	UPDATE transfer
+	SET offer_expiry_dttm = ?
+	WHERE id = ?`, time.Now().Add(-time.Minute), initUpload.TransferID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireOffers(s.db)
+
+	var answer OfferAnswer
+	readSocketFrameType(t, senderWs, socketTypeOfferAnswer, &answer)
+	if answer.Accepted || answer.Reason != offerExpired || answer.Code != user2.Code {
+		t.Errorf("got %+v", answer)
+	}
+	if messages, _ := PopPendingMessages(s.db, Hash(form2.Get("UUID")), ""); len(messages) != 0 {
+		t.Errorf("expected the expired offer to be removed got %+v", messages)
+	}
+
+	var offer TransferOffer
+	recipientWs := connectDeviceWSS(header3)
+	defer recipientWs.Close()
+	readSocketFrameType(t, recipientWs, socketTypeTransferOffer, &offer)
+	rr := postJSON(OfferResponse{TransferID: offer.TransferID, Accept: true}, header3,
+		http.HandlerFunc(s.V1AnswerOfferHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+	rr = postJSON(CompleteUploadRequest{TransferID: initUpload.TransferID, Filename: "foo.bar"}, header1,
+		http.HandlerFunc(s.V1UploadCompleteHandler))
+	if e := readError(rr); rr.Code != 409 || e.Code != ErrIncompleteUpload.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 409)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type openAPIDoc struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]openAPIProperty `json:"properties"`
+			Required   []string                   `json:"required"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIProperty struct {
+	Type                 string            `json:"type"`
+	Ref                  string            `json:"$ref"`
+	AllOf                []openAPIProperty `json:"allOf"`
+	Items                *openAPIProperty  `json:"items"`
+	AdditionalProperties *openAPIProperty  `json:"additionalProperties"`
+}
+
+func readOpenAPI(t *testing.T) (doc openAPIDoc) {
+	b, err := ioutil.ReadFile(openAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// jsonFields returns the types of all the fields of v that are marshalled by their JSON name
+func jsonFields(v interface{}) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// checkProperty returns an error if the JSON of a value of typ does not match property
+func checkProperty(property openAPIProperty, typ reflect.Type) error {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if len(property.AllOf) == 1 {
+		property = property.AllOf[0]
+	}
+	if property.Ref != "" {
+		name := strings.TrimPrefix(property.Ref, "#/components/schemas/")
+		if v, ok := openAPISchemas[name]; !ok || reflect.TypeOf(v) != typ {
+			return fmt.Errorf("%v is not %v", property.Ref, typ)
+		}
+		return nil
+	}
+
+	var expected string
+	switch {
+	case typ == reflect.TypeOf(json.RawMessage{}) || typ.Kind() == reflect.Interface:
+		// any JSON value
+		return nil
+	case typ == reflect.TypeOf(time.Time{}), typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8:
+		expected = "string"
+	case typ.Kind() == reflect.Slice, typ.Kind() == reflect.Array:
+		expected = "array"
+	case typ.Kind() == reflect.Map, typ.Kind() == reflect.Struct:
+		expected = "object"
+	case typ.Kind() == reflect.String:
+		expected = "string"
+	case typ.Kind() == reflect.Bool:
+		expected = "boolean"
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Uint64:
+		expected = "integer"
+	case typ.Kind() == reflect.Float32, typ.Kind() == reflect.Float64:
+		expected = "number"
+	default:
+		return fmt.Errorf("unsupported type %v", typ)
+	}
+	if property.Type != expected {
+		return fmt.Errorf("type %q is not %q for %v", property.Type, expected, typ)
+	}
+
+	if expected == "array" && typ.Elem().Kind() != reflect.Uint8 {
+		if property.Items == nil {
+			return fmt.Errorf("missing items for %v", typ)
+		}
+		return checkProperty(*property.Items, typ.Elem())
+	}
+	if typ.Kind() == reflect.Map && property.AdditionalProperties != nil {
+		return checkProperty(*property.AdditionalProperties, typ.Elem())
+	}
+	return nil
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := readOpenAPI(t)
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("expected OpenAPI 3 got %v", doc.OpenAPI)
+	}
+
+	r := chi.NewRouter()
+	s.Routes(r)
+	routes := make(map[string]bool)
+	err := chi.Walk(r, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		route = strings.Replace(route, "/*/", "/", -1)
+		routes[route] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for route := range routes {
+		if _, ok := doc.Paths[route]; !ok {
+			t.Errorf("route %v is missing from %v", route, openAPIPath)
+		}
+	}
+	for path := range doc.Paths {
+		if !routes[path] {
+			t.Errorf("%v documents %v which is not a route", openAPIPath, path)
+		}
+	}
+}
+
+func TestOpenAPIMethods(t *testing.T) {
+	doc := readOpenAPI(t)
+	r := chi.NewRouter()
+	s.Routes(r)
+
+	// the handlers reject the methods they don't support themselves so every method is tried on every path
+	i := 0
+	for path, operations := range doc.Paths {
+		for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+			i++
+			req, _ := http.NewRequest(method, path, strings.NewReader(""))
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i%250+1)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			_, documented := operations[strings.ToLower(method)]
+			if documented && rr.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%v %v is documented but not allowed", method, path)
+			} else if !documented && rr.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%v %v is allowed but not documented, got %v", method, path, rr.Code)
+			}
+		}
+	}
+}
+
+var openAPISchemas = map[string]interface{}{
+	"User":                    User{},
+	"Transfer":                Transfer{},
+	"TransferFile":            TransferFile{},
+	"SocketMessage":           SocketMessage{},
+	"DesktopMessage":          DesktopMessage{},
+	"IncomingSocketMessage":   IncomingSocketMessage{},
+	"SocketFrame":             SocketFrame{},
+	"Progress":                Progress{},
+	"Cancel":                  Cancel{},
+	"KeepAlive":               KeepAlive{},
+	"TransferOffer":           TransferOffer{},
+	"OfferAnswer":             OfferAnswer{},
+	"OfferResponse":           OfferResponse{},
+	"CancelRequest":           CancelRequest{},
+	"HistoryRequest":          HistoryRequest{},
+	"TransferReceipt":         TransferReceipt{},
+	"TransferEventsRequest":   TransferEventsRequest{},
+	"TransferEvent":           TransferEvent{},
+	"TransferHistory":         TransferHistory{},
+	"Signal":                  Signal{},
+	"Chunk":                   Chunk{},
+	"Error":                   APIError{},
+	"CodeRequest":             CodeRequest{},
+	"InitUploadRequest":       InitUploadRequest{},
+	"InitUploadResponse":      InitUploadResponse{},
+	"CompleteUploadRequest":   CompleteUploadRequest{},
+	"CompleteDownloadRequest": CompleteDownloadRequest{},
+	"PasswordResponse":        PasswordResponse{},
+	"CreditRequest":           CreditRequest{},
+	"CustomCodeRequest":       CustomCodeRequest{},
+	"ChallengeRequest":        ChallengeRequest{},
+	"ChallengeResponse":       ChallengeResponse{},
+	"TokenResponse":           TokenResponse{},
+	"Device":                  Device{},
+	"DeviceRequest":           DeviceRequest{},
+	"RemoveDeviceRequest":     RemoveDeviceRequest{},
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	doc := readOpenAPI(t)
+	for name, v := range openAPISchemas {
+		t.Run(name, func(t *testing.T) {
+			schema, ok := doc.Components.Schemas[name]
+			if !ok {
+				t.Fatalf("missing schema")
+			}
+			fields := jsonFields(v)
+			for property, p := range schema.Properties {
+				typ, ok := fields[property]
+				if !ok {
+					t.Errorf("property %v is not a field of the struct", property)
+				} else if err := checkProperty(p, typ); err != nil {
+					t.Errorf("property %v: %v", property, err)
+				}
+			}
+			for field := range fields {
+				if _, ok := schema.Properties[field]; !ok {
+					t.Errorf("field %v is missing from the schema", field)
+				}
+			}
+			for _, property := range schema.Required {
+				if _, ok := schema.Properties[property]; !ok {
+					t.Errorf("required property %v is not in the schema", property)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.OpenAPIHandler).ServeHTTP(rr, req)
+	var doc openAPIDoc
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); rr.Code != 200 || err != nil {
+		t.Errorf("Got %v %v", rr.Code, err)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"database/sql"
-	"github.com/go-sql-driver/mysql"
 	"github.com/patrickmn/go-cache"
 	"html/template"
 	"log"
@@ -17,14 +16,12 @@ type displayUser struct {
 }
 
 type displayTransfer struct {
-	ToUUID      string
-	FromUUID    string
-	FileHash    string
-	FileExpiry  time.Time
-	FileSize    string
-	Downloading bool
-	Finished    bool
-	Failed      bool
+	ToUUID     string
+	FromUUID   string
+	FileHash   string
+	FileExpiry time.Time
+	FileSize   string
+	State      TransferState
 }
 
 type liveContent struct {
@@ -40,7 +37,7 @@ func getAllDisplayTransfers(db *sql.DB) []displayTransfer {
 		log.Println("Refreshed transfer cache")
 		// fetch transfers from db if not in cache
 		rows, err := db.Query(`
-		SELECT from_UUID, to_UUID, expiry_dttm, size, file_hash, failed, updated_dttm, finished_dttm
+		SELECT from_UUID, to_UUID, expiry_dttm, size, IFNULL(file_hash, ''), state
 		FROM transfer`)
 		defer rows.Close()
 		Handle(err)
@@ -48,13 +45,12 @@ func getAllDisplayTransfers(db *sql.DB) []displayTransfer {
 			var (
 				dt       displayTransfer
 				fileSize int
-				updated  mysql.NullTime
-				finished mysql.NullTime
+				expiry   sql.NullTime
 			)
-			err = rows.Scan(&dt.FromUUID, &dt.ToUUID, &dt.FileExpiry, &fileSize, &dt.FileHash, &dt.Failed, &updated, &finished)
+			err = rows.Scan(&dt.FromUUID, &dt.ToUUID, &expiry, &fileSize, &dt.FileHash, &dt.State)
 			Handle(err)
-			dt.Downloading = updated.Valid
-			dt.Finished = finished.Valid
+			// transfers that have not been uploaded have no expiry
+			dt.FileExpiry = expiry.Time
 			dt.FileSize = BytesToReadable(fileSize)
 			transfers = append(transfers, dt)
 		}
@@ -63,10 +59,12 @@ func getAllDisplayTransfers(db *sql.DB) []displayTransfer {
 	return transfers
 }
 
+const openAPIPath = "web/openapi.json"
+
 // LiveHandler returns a page displaying all historic transfers
 func (s *Server) LiveHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		WriteError(w, r, 400, "Invalid method")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 	tmplPath := "web/templates/live.html"
@@ -78,3 +76,13 @@ func (s *Server) LiveHandler(w http.ResponseWriter, r *http.Request) {
 	err := tmpl.Execute(w, data)
 	Handle(err)
 }
+
+// OpenAPIHandler serves the OpenAPI specification of all the routes
+func (s *Server) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, openAPIPath)
+}
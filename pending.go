@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pendingMessageLifeHours is how long a message that does not refer to a transfer waits for the user to connect
+const pendingMessageLifeHours = 24
+
+// DedupKey identifies messages that replace each other while waiting to be delivered. Only the latest stats and
+// progress of a transfer are kept and a transfer is only offered once.
+func (message SocketMessage) DedupKey() string {
+	switch message.Type() {
+	case socketTypeDownloadOffer, socketTypeProgress:
+		return message.Type() + ":" + message.FilePath()
+	case socketTypeCancel:
+		return message.Type() + ":" + strconv.FormatInt(message.Cancel.TransferID, 10) + ":" + message.FilePath()
+	case socketTypeStats:
+		return message.Type()
+	case socketTypeTransferOffer:
+		return message.Type() + ":" + strconv.FormatInt(message.Offer.TransferID, 10)
+	}
+	b, err := json.Marshal(message)
+	Handle(err)
+	return message.Type() + ":" + HashWithBytes(b)
+}
+
+// FilePath returns the path of the transfer the message refers to
+func (message SocketMessage) FilePath() string {
+	switch {
+	case message.Download != nil:
+		return message.Download.FilePath
+	case message.Progress != nil:
+		return message.Progress.FilePath
+	case message.Cancel != nil:
+		return message.Cancel.FilePath
+	}
+	return ""
+}
+
+// Expiry returns when the message is no longer worth delivering. Messages about a transfer expire with the transfer.
+func (message SocketMessage) Expiry(db *sql.DB) time.Time {
+	if message.Download != nil && !message.Download.Expiry.IsZero() {
+		return message.Download.Expiry
+	}
+	if message.Offer != nil {
+		return message.Offer.Expiry
+	}
+	if filePath := message.FilePath(); filePath != "" {
+		var expiry sql.NullTime
+		result := db.QueryRow(`
+		SELECT MAX(expiry_dttm)
+		FROM transfer
+		WHERE file_path = ?
+		AND finished_dttm IS NULL`, filePath)
+		if err := result.Scan(&expiry); err == nil && expiry.Valid {
+			return expiry.Time
+		}
+	}
+	return time.Now().Add(time.Hour * pendingMessageLifeHours)
+}
+
+// StorePendingMessage stores a message for every device of the user with the hashed UUID to receive when it next
+// connects. A waiting message with the same DedupKey is replaced.
+func StorePendingMessage(db *sql.DB, hashUUID string, message SocketMessage) error {
+	rows, err := db.Query(`
+	SELECT device_id
+	FROM device
+	WHERE UUID = ?`, hashUUID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// the device that created the account is not registered
+	devices := []string{""}
+	for rows.Next() {
+		var device string
+		if err := rows.Scan(&device); err != nil {
+			return err
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return storePendingMessage(db, hashUUID, devices, message)
+}
+
+// StoreDevicePendingMessage stores a message for a single device of the user with the hashed UUID
+func StoreDevicePendingMessage(db *sql.DB, hashUUID string, device string, message SocketMessage) error {
+	return storePendingMessage(db, hashUUID, []string{device}, message)
+}
+
+func storePendingMessage(db *sql.DB, hashUUID string, devices []string, message SocketMessage) error {
+	b, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	dedupKey, expiry := message.DedupKey(), message.Expiry(db)
+
+	// REPLACE deletes a waiting message with the same DedupKey before inserting so that the message gets a new id
+	// and is replayed in the order it was last stored
+	var args []interface{}
+	for _, device := range devices {
+		args = append(args, hashUUID, device, dedupKey, string(b), expiry)
+	}
+	_, err = db.Exec(`
+	REPLACE INTO pending_message (UUID, device_id, dedup_key, message, expiry_dttm)
+	VALUES (?, ?, ?, ?, ?)`+strings.Repeat(", (?, ?, ?, ?, ?)", len(devices)-1), args...)
+	return err
+}
+
+// PopPendingMessages removes and returns the unexpired messages waiting for a device of the user with the hashed
+// UUID in the order they were stored
+func PopPendingMessages(db *sql.DB, hashUUID string, device string) (messages []SocketMessage, err error) {
+	err = inTx(db, func(tx *sql.Tx) error {
+		var lastID int64
+		messages, lastID, err = readPendingMessages(tx, hashUUID, device)
+		if err != nil || lastID == 0 {
+			return err
+		}
+		_, err = tx.Exec(`
+		DELETE FROM pending_message
+		WHERE UUID = ?
+		AND device_id = ?
+		AND id <= ?`, hashUUID, device, lastID)
+		return err
+	})
+	return messages, err
+}
+
+// readPendingMessages locks and reads the unexpired messages waiting for a device returning the last id read
+func readPendingMessages(tx *sql.Tx, hashUUID string, device string) ([]SocketMessage, int64, error) {
+	rows, err := tx.Query(`
+	SELECT id, message, expiry_dttm
+	FROM pending_message
+	WHERE UUID = ?
+	AND device_id = ?
+	ORDER BY id
+	FOR UPDATE`, hashUUID, device)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		messages []SocketMessage
+		lastID   int64
+	)
+	for rows.Next() {
+		var (
+			b      string
+			expiry sql.NullTime
+		)
+		if err := rows.Scan(&lastID, &b, &expiry); err != nil {
+			return nil, 0, err
+		}
+		if expiry.Valid && expiry.Time.Before(time.Now()) {
+			continue
+		}
+		var message SocketMessage
+		if err := json.Unmarshal([]byte(b), &message); err != nil {
+			Handle(err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, lastID, rows.Err()
+}
+
+// DeletePendingMessage removes a waiting message with dedupKey for the user with UUID
+func DeletePendingMessage(db *sql.DB, UUID string, dedupKey string) error {
+	_, err := db.Exec(`
+	DELETE FROM pending_message
+	WHERE UUID = ?
+	AND dedup_key = ?`, Hash(UUID), dedupKey)
+	return err
+}
+
+// cleanExpiredMessages removes messages that expired before the user connected
+func cleanExpiredMessages(db *sql.DB) {
+	_, err := db.Exec(`
+	DELETE FROM pending_message
+	WHERE expiry_dttm < NOW()`)
+	Handle(err)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingMessages(t *testing.T) {
+	hashUUID := Hash(RandomString(20))
+	stats := func(code string) SocketMessage { return SocketMessage{User: &User{Code: code}} }
+	expired := SocketMessage{Download: &Transfer{FilePath: "expired/", Expiry: time.Now().Add(-time.Minute)}}
+	offer := SocketMessage{Download: &Transfer{FilePath: "foo/", Expiry: time.Now().Add(time.Hour)}}
+
+	for _, message := range []SocketMessage{
+		offer,
+		stats("a"),
+		expired,
+		{Message: &DesktopMessage{Title: "foo"}},
+		offer,
+		stats("b"),
+	} {
+		if err := StorePendingMessage(s.db, hashUUID, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// duplicates are only replayed once in the order they were last stored and the latest stats win
+	messages, err := PopPendingMessages(s.db, hashUUID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("got %+v", messages)
+	}
+	if messages[0].Message == nil || messages[0].Message.Title != "foo" {
+		t.Errorf("got %+v", messages[0])
+	}
+	if messages[1].Download == nil || messages[1].Download.FilePath != "foo/" {
+		t.Errorf("got %+v", messages[1])
+	}
+	if messages[2].User == nil || messages[2].User.Code != "b" {
+		t.Errorf("got %+v", messages[2])
+	}
+
+	if messages, err = PopPendingMessages(s.db, hashUUID, ""); err != nil || len(messages) != 0 {
+		t.Errorf("got %+v %v", messages, err)
+	}
+}
+
+func TestPendingMessagesReplayed(t *testing.T) {
+	user, form := genUser()
+
+	// messages for a user that is not connected are kept in the db rather than in memory
+	WSConns.Write(s.db, SocketMessage{Message: &DesktopMessage{Title: "foo"}}, form.Get("UUID"), true)
+	WSConns.Write(s.db, SocketMessage{Message: &DesktopMessage{Title: "bar"}}, form.Get("UUID"), true)
+
+	ws := connectWSSV2(user, form)
+	defer ws.Close()
+	for _, title := range []string{"foo", "bar"} {
+		frame := readSocketFrame(t, ws)
+		if frame.Type != socketTypeMessage || !strings.Contains(string(frame.Payload), title) {
+			t.Errorf("got %+v wanted %v", frame, title)
+		}
+	}
+}
+
+func TestPendingMessagesPerDevice(t *testing.T) {
+	user, header := v1User(t)
+	device, deviceHeader := registerDevice(t, header)
+	WSConns.Write(s.db, SocketMessage{Message: &DesktopMessage{Title: "foo"}}, user.UUID, true)
+
+	// every device is replayed the messages that were sent while none of them was connected
+	for _, h := range []http.Header{header, deviceHeader} {
+		ws := connectDeviceWSS(h)
+		frame := readSocketFrame(t, ws)
+		if frame.Type != socketTypeMessage || !strings.Contains(string(frame.Payload), "foo") {
+			t.Errorf("got %+v", frame)
+		}
+		ws.Close()
+	}
+
+	// the messages of a removed device are removed with it
+	Handle(StoreDevicePendingMessage(s.db, Hash(user.UUID), device.ID, SocketMessage{Message: &DesktopMessage{}}))
+	if err := s.RemoveDevice(user, device.ID); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := PopPendingMessages(s.db, Hash(user.UUID), device.ID); err != nil || len(messages) != 0 {
+		t.Errorf("got %+v %v", messages, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"time"
+)
+
+// staleConnectionMins is how long an instance can go without marking its sockets as seen before they are removed
+const staleConnectionMins = 3
+
+// instanceID identifies the sockets held by this instance of the backend. It is set by instance_id, falling back to
+// the host name, and should be stable across restarts so that the sockets of a previous run can be removed on start
+// up.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	if ID := os.Getenv("instance_id"); ID != "" {
+		return ID
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return RandomString(20)
+}
+
+// Connected records a socket of user held by this instance and marks the user and their device as connected. It
+// returns the ID of the socket for Disconnected.
+func Connected(db *sql.DB, user User) (int64, error) {
+	res, err := db.Exec(`
+	INSERT INTO connection (UUID, device_id, instance_id)
+	VALUES (?, ?, ?)`, Hash(user.UUID), user.DeviceID, instanceID)
+	if err != nil {
+		return 0, err
+	}
+	ID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return ID, updateConnected(db, Hash(user.UUID))
+}
+
+// Disconnected removes the socket with ID of user. The user and their device stay connected while they have a
+// socket on any instance.
+func Disconnected(db *sql.DB, user User, ID int64) error {
+	if _, err := db.Exec(`
+	DELETE FROM connection
+	WHERE id = ?`, ID); err != nil {
+		return err
+	}
+	return updateConnected(db, Hash(user.UUID))
+}
+
+// updateConnected sets whether the user with UUIDHash and each of their devices have a socket on any instance
+func updateConnected(db *sql.DB, UUIDHash string) error {
+	rows, err := db.Query(`
+	SELECT DISTINCT device_id
+	FROM connection
+	WHERE UUID = ?`, UUIDHash)
+	if err != nil {
+		return err
+	}
+	var devices []string
+	for rows.Next() {
+		var device string
+		if err := rows.Scan(&device); err != nil {
+			rows.Close()
+			return err
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+	UPDATE user
+	SET is_connected = ?
+	WHERE UUID = ?`, len(devices) > 0, UUIDHash); err != nil {
+		return err
+	}
+	// the device of the account itself has no ID so the list is never empty
+	args := []interface{}{""}
+	for _, device := range devices {
+		args = append(args, device)
+	}
+	_, err = db.Exec(`
+	UPDATE device
+	SET is_connected = device_id IN (?`+strings.Repeat(", ?", len(devices))+`)
+	WHERE UUID = ?`, append(args, UUIDHash)...)
+	return err
+}
+
+// removeConnections removes the sockets matching where and updates whether their users are still connected
+func removeConnections(db *sql.DB, where string, args ...interface{}) {
+	rows, err := db.Query(`
+	SELECT DISTINCT UUID
+	FROM connection
+	WHERE `+where, args...)
+	if err != nil {
+		Handle(err)
+		return
+	}
+	var UUIDs []string
+	for rows.Next() {
+		var UUID string
+		Handle(rows.Scan(&UUID))
+		UUIDs = append(UUIDs, UUID)
+	}
+	Handle(rows.Close())
+
+	_, err = db.Exec(`
+	DELETE FROM connection
+	WHERE `+where, args...)
+	Handle(err)
+	for _, UUID := range UUIDs {
+		Handle(updateConnected(db, UUID))
+	}
+}
+
+// ResetConnected removes the sockets of a previous run of this instance. No web socket survives a restart so this is
+// run on start up. The sockets held by other instances are left alone.
+func ResetConnected(db *sql.DB) {
+	removeConnections(db, `instance_id = ?`, instanceID)
+}
+
+// refreshConnections marks the sockets of this instance as seen and removes the sockets of instances that have not
+// been seen for staleConnectionMins so that an instance that stopped without cleaning up does not leave its users
+// connected
+func refreshConnections(db *sql.DB) {
+	_, err := db.Exec(`
+	UPDATE connection
+	SET seen_dttm = NOW()
+	WHERE instance_id = ?`, instanceID)
+	Handle(err)
+	removeConnections(db, `seen_dttm < ?`, time.Now().Add(-time.Minute*staleConnectionMins))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceAcrossInstances(t *testing.T) {
+	user, form := genUser()
+	UUID := form.Get("UUID")
+
+	// the user also has a socket on another instance
+	_, err := s.db.Exec(`
+	INSERT INTO connection (UUID, device_id, instance_id)
+	VALUES (?, '', 'other')`, Hash(UUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws := connectWSSV2(user, form)
+	time.Sleep(time.Millisecond * 20)
+	if !isConnected(t, UUID) {
+		t.Errorf("expected client to be connected")
+	}
+
+	// closing the socket on this instance or restarting it leaves the user connected to the other instance
+	ws.Close()
+	time.Sleep(time.Millisecond * 20)
+	if !isConnected(t, UUID) {
+		t.Errorf("expected client to still be connected to the other instance")
+	}
+	ResetConnected(s.db)
+	if !isConnected(t, UUID) {
+		t.Errorf("expected client to still be connected to the other instance")
+	}
+
+	// the sockets of an instance that has stopped are removed once they are stale
+	refreshConnections(s.db)
+	if !isConnected(t, UUID) {
+		t.Errorf("expected client to still be connected to the other instance")
+	}
+	_, err = s.db.Exec(`
+	UPDATE connection
+	SET seen_dttm = ?
+	WHERE instance_id = 'other'`, time.Now().Add(-time.Minute*(staleConnectionMins+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshConnections(s.db)
+	if isConnected(t, UUID) {
+		t.Errorf("expected client to be disconnected")
+	}
+}
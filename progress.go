@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/patrickmn/go-cache"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	progressUpload   = "upload"
+	progressDownload = "download"
+	// progressIntervalMs is the minimum time between two progress events of a transfer
+	progressIntervalMs = 500
+	// progressLifeMins is how long the progress of a transfer that has stopped moving is remembered
+	progressLifeMins = 30
+)
+
+// trackers of the transfers currently moving by direction and transfer ID
+var transferProgress = cache.New(time.Minute*progressLifeMins, time.Minute*5)
+
+// ProgressTracker counts the bytes of a transfer moving in one direction and sends throttled progress events to the
+// sender and recipients of the transfer. Events are sent in the background so that a slow socket never holds up the
+// transfer and an event that is still waiting to be sent is replaced by a newer one.
+type ProgressTracker struct {
+	db       *sql.DB
+	progress Progress
+	// users to send the progress events to
+	UUIDs []string
+
+	// bytes and time the throughput is measured from
+	startBytes int
+	started    time.Time
+	sent       time.Time
+	// the event for the last byte has been sent
+	done bool
+	// the latest event that has not been sent yet and whether it is being sent
+	pending *Progress
+	sending bool
+	sync.Mutex
+}
+
+// TrackProgress returns the tracker of the transfer in direction creating it if the transfer is not already being
+// tracked. UUIDs are the users that are sent the progress events.
+func TrackProgress(db *sql.DB, direction string, transfer Transfer, UUIDs ...string) *ProgressTracker {
+	key := direction + ":" + strconv.FormatInt(transfer.ID, 10)
+	if tracker, ok := transferProgress.Get(key); ok {
+		transferProgress.Set(key, tracker, cache.DefaultExpiration)
+		t := tracker.(*ProgressTracker)
+		t.Lock()
+		t.UUIDs = UUIDs
+		t.Unlock()
+		return t
+	}
+
+	tracker := &ProgressTracker{
+		db: db,
+		progress: Progress{
+			Direction:  direction,
+			TransferID: transfer.ID,
+			FilePath:   transfer.FilePath,
+			Size:       transfer.Size,
+		},
+		UUIDs:   UUIDs,
+		started: time.Now(),
+	}
+	transferProgress.Set(key, tracker, cache.DefaultExpiration)
+	return tracker
+}
+
+// Seek restarts the tracker at bytes, for example when a download is resumed with a Range request
+func (tracker *ProgressTracker) Seek(bytes int) {
+	tracker.Lock()
+	tracker.progress.Bytes = bytes
+	tracker.startBytes = bytes
+	tracker.started = time.Now()
+	tracker.done = false
+	tracker.Unlock()
+}
+
+// Add counts n more bytes and sends a progress event if none has been sent for progressIntervalMs or the transfer
+// has finished moving
+func (tracker *ProgressTracker) Add(n int) {
+	tracker.Lock()
+	tracker.progress.Bytes += n
+	if tracker.progress.Bytes > tracker.progress.Size {
+		// chunks that are sent again are counted twice and a tar of a bundle is larger than its files
+		tracker.progress.Bytes = tracker.progress.Size
+	}
+	now := time.Now()
+	done := tracker.progress.Bytes == tracker.progress.Size
+	if tracker.done || (!done && now.Sub(tracker.sent) < time.Millisecond*progressIntervalMs) {
+		tracker.Unlock()
+		return
+	}
+	tracker.sent = now
+	tracker.done = done
+	progress := tracker.snapshot(now)
+	tracker.pending = &progress
+	if !tracker.sending {
+		tracker.sending = true
+		go tracker.send()
+	}
+	tracker.Unlock()
+}
+
+// send sends the pending event until there is none left
+func (tracker *ProgressTracker) send() {
+	for {
+		tracker.Lock()
+		progress, UUIDs := tracker.pending, tracker.UUIDs
+		tracker.pending = nil
+		if progress == nil {
+			tracker.sending = false
+			tracker.Unlock()
+			return
+		}
+		tracker.Unlock()
+
+		for _, UUID := range UUIDs {
+			WSConns.Write(tracker.db, SocketMessage{Progress: progress}, UUID, false)
+		}
+	}
+}
+
+// snapshot calculates the percentage, throughput and ETA of the progress at now
+func (tracker *ProgressTracker) snapshot(now time.Time) Progress {
+	progress := tracker.progress
+	if progress.Size > 0 {
+		progress.Percent = math.Round(float64(progress.Bytes)*1000/float64(progress.Size)) / 10
+	}
+	if elapsed := now.Sub(tracker.started).Seconds(); elapsed > 0 {
+		progress.BytesPerSec = int(float64(progress.Bytes-tracker.startBytes) / elapsed)
+	}
+	if progress.BytesPerSec > 0 {
+		progress.ETASecs = (progress.Size - progress.Bytes) / progress.BytesPerSec
+	}
+	return progress
+}
+
+// Reader counts the bytes read from r
+func (tracker *ProgressTracker) Reader(r io.Reader) io.Reader {
+	return progressReader{r: r, tracker: tracker}
+}
+
+// Writer counts the bytes written to w
+func (tracker *ProgressTracker) Writer(w io.Writer) io.Writer {
+	return progressWriter{w: w, tracker: tracker}
+}
+
+type progressReader struct {
+	r       io.Reader
+	tracker *ProgressTracker
+}
+
+func (p progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.tracker.Add(n)
+	}
+	return n, err
+}
+
+type progressWriter struct {
+	w       io.Writer
+	tracker *ProgressTracker
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.tracker.Add(n)
+	}
+	return n, err
+}
+
+// Parties returns the UUIDs of the sender and every recipient of the group of an uploading transfer
+func (transfer Transfer) Parties(db *sql.DB) []string {
+	var fromUUID string
+	Handle(db.QueryRow(`
+	SELECT from_UUID
+	FROM transfer
+	WHERE id = ?`, transfer.ID).Scan(&fromUUID))
+
+	UUIDs := []string{fromUUID}
+	group, err := transfer.GetGroup(db)
+	Handle(err)
+	for _, member := range group {
+		UUIDs = append(UUIDs, member.to.UUID)
+	}
+	return UUIDs
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readProgress reads frames until the progress event of direction that reaches the end of the transfer
+func readProgress(t *testing.T, ws *websocket.Conn, direction string) (progress Progress) {
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second * 2))
+	defer func() { _ = ws.SetReadDeadline(time.Time{}) }()
+	for {
+		frame := readSocketFrame(t, ws)
+		if frame.Type != socketTypeProgress {
+			continue
+		}
+		if err := json.Unmarshal(frame.Payload, &progress); err != nil {
+			t.Fatal(err)
+		}
+		if progress.Direction == direction && progress.Bytes == progress.Size {
+			return
+		}
+	}
+}
+
+func TestProgressSnapshot(t *testing.T) {
+	now := time.Now()
+	tracker := &ProgressTracker{progress: Progress{Size: 400}}
+	tracker.Seek(50)
+	tracker.started = now.Add(-time.Second)
+	tracker.progress.Bytes = 150
+
+	progress := tracker.snapshot(now)
+	if progress.Percent != 37.5 || progress.BytesPerSec != 100 || progress.ETASecs != 2 {
+		t.Errorf("got %+v", progress)
+	}
+
+	// progress events are throttled until the last byte
+	tracker.sent = now
+	tracker.Add(10)
+	if !tracker.sent.Equal(now) {
+		t.Errorf("expected the event to be throttled")
+	}
+	tracker.Add(400)
+	if tracker.sent.Equal(now) || !tracker.done || tracker.progress.Bytes != 400 {
+		t.Errorf("expected the last event to be sent got %+v", tracker.progress)
+	}
+}
+
+func TestProgressCoalesced(t *testing.T) {
+	tracker := &ProgressTracker{progress: Progress{Size: 400}}
+
+	// while an event is being sent newer events replace the one waiting to be sent
+	tracker.sending = true
+	tracker.Add(100)
+	tracker.sent = time.Time{}
+	tracker.Add(100)
+	if tracker.pending == nil || tracker.pending.Bytes != 200 {
+		t.Errorf("got %+v", tracker.pending)
+	}
+	tracker.Add(200)
+	if tracker.pending.Bytes != 400 || !tracker.done {
+		t.Errorf("got %+v", tracker.pending)
+	}
+
+	// the sender stops once there is nothing left to send
+	tracker.send()
+	if tracker.sending || tracker.pending != nil {
+		t.Errorf("got %+v", tracker.pending)
+	}
+
+	// a new download of the transfer is followed from the start
+	tracker.Seek(0)
+	tracker.Add(400)
+	time.Sleep(time.Millisecond * time.Duration(10))
+	tracker.Lock()
+	defer tracker.Unlock()
+	if !tracker.done || tracker.sending || tracker.progress.Bytes != 400 {
+		t.Errorf("got %+v", tracker.progress)
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	senderWs := connectDeviceWSS(header1)
+	defer senderWs.Close()
+	recipientWs := connectDeviceWSS(header2)
+	defer recipientWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	fileBytes := []byte(RandomString(100))
+	rr := postJSON(InitUploadRequest{Filesize: len(fileBytes), Codes: []string{user2.Code}}, header1,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var initUpload InitUploadResponse
+	_ = json.Unmarshal(rr.Body.Bytes(), &initUpload)
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// both parties follow the upload
+	credentials := url.Values{"UUID": {user1.UUID}, "UUID_key": {user1.UUIDKey}}
+	transferID := strconv.FormatInt(initUpload.TransferID, 10)
+	uploadChunk(credentials, transferID, 0, fileBytes[:60])
+	uploadChunk(credentials, transferID, 60, fileBytes[60:])
+	for _, ws := range []*websocket.Conn{senderWs, recipientWs} {
+		progress := readProgress(t, ws, progressUpload)
+		if progress.TransferID != initUpload.TransferID || progress.Size != 100 || progress.Percent != 100 {
+			t.Errorf("got %+v", progress)
+		}
+	}
+
+	rr = postJSON(CompleteUploadRequest{
+		TransferID: initUpload.TransferID,
+		Filename:   "foo.bar",
+		Passwords:  map[string]string{"password": "foo"},
+	}, header1, http.HandlerFunc(s.V1UploadCompleteHandler))
+	if rr.Code != 204 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+	var offer Transfer
+	for offer.FilePath == "" {
+		frame := readSocketFrame(t, recipientWs)
+		if frame.Type == socketTypeDownloadOffer {
+			_ = json.Unmarshal(frame.Payload, &offer)
+		}
+	}
+
+	// the sender follows the download
+	rr = postRequestWithHeader(url.Values{"file_path": {offer.FilePath}}, header2, http.HandlerFunc(s.DownloadHandler))
+	if rr.Body.String() != string(fileBytes) {
+		t.Fatalf("Got %v expected %v", rr.Body.String(), string(fileBytes))
+	}
+	progress := readProgress(t, senderWs, progressDownload)
+	if progress.FilePath != offer.FilePath || progress.Size != 100 || progress.Percent != 100 {
+		t.Errorf("got %+v", progress)
+	}
+	rr = postJSON(CompleteDownloadRequest{FilePath: offer.FilePath, Hash: HashWithBytes(fileBytes)}, header2,
+		http.HandlerFunc(s.V1CompletedDownloadHandler))
+	if rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"github.com/didip/tollbooth"
+	"github.com/patrickmn/go-cache"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recoveryCodeLen      = 8
+	recoveryCodeLifeMins = 15
+	maxRecoveryAttempts  = 5
+	// recoveryAttemptsLifeHours is how long the recovery code attempts of a user are counted for
+	recoveryAttemptsLifeHours = 24
+
+	recoveryMethodSignature = "signature"
+	recoveryMethodEmailCode = "email_code"
+	recoveryMethodEmail     = "email"
+)
+
+// recoveryCode is a code emailed to a user so they can prove they own the email attached to their credit
+type recoveryCode struct {
+	hash string
+	sync.Mutex
+}
+
+// recoveryCodes maps the hashed UUID of a user to the recoveryCode sent to them
+var recoveryCodes = cache.New(time.Minute*recoveryCodeLifeMins, time.Minute*5)
+
+// recoveryAttempts counts the recovery codes tried for the hashed UUID of a user across every code sent to them so
+// that requesting a new code does not allow more guesses
+var recoveryAttempts = cache.New(time.Hour*recoveryAttemptsLifeHours, time.Minute*5)
+
+// newRecoveryCode generates a random numeric code that is easy to type from an email
+func newRecoveryCode() (string, error) {
+	var b strings.Builder
+	for i := 0; i < recoveryCodeLen; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(n.String())
+	}
+	return b.String(), nil
+}
+
+// CheckRecoveryCode verifies code against the code sent to user. After maxRecoveryAttempts within
+// recoveryAttemptsLifeHours no code is accepted, even one that was requested after the attempts. A code can only be
+// used once.
+func CheckRecoveryCode(user User, code string) bool {
+	hashedUUID := Hash(user.UUID)
+	v, ok := recoveryCodes.Get(hashedUUID)
+	if !ok {
+		return false
+	}
+	rc := v.(*recoveryCode)
+	rc.Lock()
+	defer rc.Unlock()
+
+	_ = recoveryAttempts.Add(hashedUUID, 0, cache.DefaultExpiration)
+	if attempts, err := recoveryAttempts.IncrementInt(hashedUUID, 1); err != nil || attempts > maxRecoveryAttempts {
+		recoveryCodes.Delete(hashedUUID)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(HashWithBytes([]byte(code))), []byte(rc.hash)) != 1 {
+		return false
+	}
+	recoveryCodes.Delete(hashedUUID)
+	recoveryAttempts.Delete(hashedUUID)
+	return true
+}
+
+// LogKeyRecovery records an attempt to recover the UUID key of a user
+func LogKeyRecovery(db *sql.DB, user User, method string, ip string, success bool) {
+	_, err := db.Exec(`
+	INSERT INTO key_recovery (UUID, method, success, ip, created_dttm)
+	VALUES (?, ?, ?, ?, NOW())`, Hash(user.UUID), method, success, ip)
+	Handle(err)
+}
+
+// remoteIP returns the IP of the client making the request. The X-Forwarded-For and X-Real-IP headers are only
+// trusted when the request comes from one of the comma separated trusted_proxies.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	// the closest address to the server that is not one of the proxies is the client
+	if ips := r.Header.Get("X-Forwarded-For"); ips != "" {
+		forwarded := strings.Split(ips, ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			if ip = strings.TrimSpace(forwarded[i]); !isTrustedProxy(ip) {
+				return ip
+			}
+		}
+		return ip
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	return ip
+}
+
+// RecoveryLimitHandler limits requests with recoveryLmt by the IP of the client from remoteIP and separately by the
+// UUID being recovered so that neither one client nor guesses spread over many clients can get through
+func RecoveryLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			WriteError(w, r, ErrInvalidForm)
+			return
+		}
+		for _, key := range []string{"ip:" + remoteIP(r), "UUID:" + Hash(r.Form.Get("UUID"))} {
+			if tollbooth.LimitByKeys(recoveryLmt, []string{key}) != nil {
+				WriteError(w, r, ErrRateLimited)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isTrustedProxy(ip string) bool {
+	for _, proxy := range envKeys("trusted_proxies") {
+		if proxy == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// RecoverHandler rotates the UUID key of a user who has lost it. Ownership of the account is proven either by
+// authenticating with a signed challenge (see ChallengeHandler) or with a recovery code sent to the email attached
+// to the credit of the user. Posting just the email sends the recovery code, posting the email and recovery_code
+// rotates the key. Every attempt is recorded in the key_recovery table.
+func (s *Server) RecoverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, r, ErrInvalidMethod)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	user := User{UUID: r.Form.Get("UUID")}
+	if !IsValidUUID(user.UUID) {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+	if _, exists := user.GetUUIDKey(s.db); !exists {
+		WriteError(w, r, ErrInvalidForm)
+		return
+	}
+
+	ip := remoteIP(r)
+	email := strings.TrimSpace(r.Form.Get("email"))
+	code := r.Form.Get("recovery_code")
+
+	if auth, ok := AuthFromContext(r); ok && auth.Method == authMethodChallenge && auth.User.UUID == user.UUID {
+		LogKeyRecovery(s.db, user, recoveryMethodSignature, ip, true)
+		s.rotateUUIDKey(w, user)
+		return
+	}
+
+	if email == "" {
+		LogKeyRecovery(s.db, user, recoveryMethodSignature, ip, false)
+		WriteError(w, r, ErrInvalidCredentials)
+		return
+	}
+
+	if code != "" {
+		if !CheckRecoveryCode(user, code) {
+			LogKeyRecovery(s.db, user, recoveryMethodEmailCode, ip, false)
+			WriteError(w, r, ErrInvalidRecoveryCode)
+			return
+		}
+		LogKeyRecovery(s.db, user, recoveryMethodEmailCode, ip, true)
+		s.rotateUUIDKey(w, user)
+		return
+	}
+
+	if mailer == nil {
+		WriteError(w, r, ErrNotEnabled.WithMessage("Email recovery is not enabled"))
+		return
+	}
+
+	// always respond the same so the endpoint can't be used to find the email of a user
+	hasEmail := HasCreditEmail(s.db, user, email)
+	LogKeyRecovery(s.db, user, recoveryMethodEmail, ip, hasEmail)
+	if hasEmail {
+		code, err := newRecoveryCode()
+		if err != nil {
+			Handle(err)
+			WriteError(w, r, ErrInternal.WithMessage("Failed to create recovery code"))
+			return
+		}
+		recoveryCodes.Set(Hash(user.UUID), &recoveryCode{hash: HashWithBytes([]byte(code))}, cache.DefaultExpiration)
+		body := fmt.Sprintf("Your Transfer Me It recovery code is %s\n\nIt will expire in %d minutes.", code,
+			recoveryCodeLifeMins)
+		if err := mailer.Send(email, "Transfer Me It recovery code", body); err != nil {
+			Handle(err)
+			WriteError(w, r, ErrInternal.WithMessage("Failed to send recovery code"))
+			return
+		}
+	}
+	Handle(WriteJSON(w, struct {
+		Message string `json:"message"`
+	}{"If the email is attached to the account a recovery code has been sent"}))
+}
+
+// rotateUUIDKey sets a new UUID key for user and writes it to w
+func (s *Server) rotateUUIDKey(w http.ResponseWriter, user User) {
+	user.UUIDKey = RandomString(keyUUIDLen)
+	user.UpdateUUIDKey(s.db)
+	Handle(WriteJSON(w, struct {
+		UUIDKey string `json:"UUID_key"`
+	}{user.UUIDKey}))
+}
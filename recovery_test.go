@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeMailer keeps the last email sent
+type fakeMailer struct {
+	to   string
+	body string
+}
+
+func (m *fakeMailer) Send(to, subject, body string) error {
+	m.to = to
+	m.body = body
+	return nil
+}
+
+func recoveryCount(user User, success bool) (count int) {
+	Handle(s.db.QueryRow(`SELECT COUNT(*) FROM key_recovery WHERE UUID = ? AND success = ?`,
+		Hash(user.UUID), success).Scan(&count))
+	return
+}
+
+func TestSignatureKeyRecovery(t *testing.T) {
+	privateKey, user, form := genKeyUser(t)
+	user.UUID = form.Get("UUID")
+
+	// without proof of ownership
+	rr := postRequest(url.Values{"UUID": {user.UUID}}, http.HandlerFunc(s.RecoverHandler))
+	if rr.Code != 401 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	challenge := getChallenge(t, user.UUID)
+	recoverForm := url.Values{}
+	recoverForm.Set("UUID", user.UUID)
+	recoverForm.Set("challenge", challenge)
+	recoverForm.Set("signature", signChallenge(privateKey, challenge))
+	rr = postRequest(recoverForm, http.HandlerFunc(s.RecoverHandler))
+	var newKey User
+	_ = json.Unmarshal(rr.Body.Bytes(), &newKey)
+	if rr.Code != 200 || newKey.UUIDKey == "" || newKey.UUIDKey == user.UUIDKey {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	if user.IsValid(s.db) {
+		t.Errorf("old UUID key should no longer be valid")
+	}
+	user.UUIDKey = newKey.UUIDKey
+	if !user.IsValid(s.db) {
+		t.Errorf("new UUID key should be valid")
+	}
+
+	if recoveryCount(user, true) != 1 || recoveryCount(user, false) != 1 {
+		t.Errorf("expected an audit entry for every recovery attempt")
+	}
+
+	// a form that can't be parsed
+	req, _ := http.NewRequest("POST", "", strings.NewReader("UUID=%zz"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.RecoverHandler).ServeHTTP(rr, req)
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrInvalidForm.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+}
+
+func TestEmailKeyRecovery(t *testing.T) {
+	m := &fakeMailer{}
+	mailer = m
+	defer func() { mailer = nil }()
+
+	user, form := genCreditUser(1)
+	user.UUID = form.Get("UUID")
+	var email string
+	Handle(s.db.QueryRow(`SELECT email FROM credit WHERE UUID = ?`, Hash(user.UUID)).Scan(&email))
+
+	// wrong email doesn't send a code
+	recoverForm := url.Values{}
+	recoverForm.Set("UUID", user.UUID)
+	recoverForm.Set("email", "not"+email)
+	rr := postRequest(recoverForm, http.HandlerFunc(s.RecoverHandler))
+	if rr.Code != 200 || m.body != "" {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	recoverForm.Set("email", strings.ToUpper(email))
+	rr = postRequest(recoverForm, http.HandlerFunc(s.RecoverHandler))
+	if rr.Code != 200 || m.to != strings.ToUpper(email) {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	code := regexp.MustCompile(`[0-9]{8}`).FindString(m.body)
+	if code == "" {
+		t.Fatalf("expected recovery code in %v", m.body)
+	}
+
+	recoverForm.Set("recovery_code", "wrong")
+	rr = postRequest(recoverForm, http.HandlerFunc(s.RecoverHandler))
+	if rr.Code != 401 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	recoverForm.Set("recovery_code", code)
+	rr = postRequest(recoverForm, http.HandlerFunc(s.RecoverHandler))
+	var newKey User
+	_ = json.Unmarshal(rr.Body.Bytes(), &newKey)
+	if rr.Code != 200 || newKey.UUIDKey == "" {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	user.UUIDKey = newKey.UUIDKey
+	if !user.IsValid(s.db) {
+		t.Errorf("new UUID key should be valid")
+	}
+
+	// codes can only be used once
+	rr = postRequest(recoverForm, http.HandlerFunc(s.RecoverHandler))
+	if rr.Code != 401 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 401)
+	}
+
+	if recoveryCount(user, true) != 2 || recoveryCount(user, false) != 3 {
+		t.Errorf("expected an audit entry for every recovery attempt")
+	}
+}
+
+func TestRecoveryCodeAttempts(t *testing.T) {
+	user := User{UUID: RandomString(10)}
+	recoveryCodes.Set(Hash(user.UUID), &recoveryCode{hash: HashWithBytes([]byte("12345678"))}, 0)
+	for i := 0; i < maxRecoveryAttempts; i++ {
+		if CheckRecoveryCode(user, "00000000") {
+			t.Fatalf("wrong code should be invalid")
+		}
+	}
+	if CheckRecoveryCode(user, "12345678") {
+		t.Errorf("code should be discarded after %v attempts", maxRecoveryAttempts)
+	}
+
+	// requesting a new code doesn't allow more attempts
+	recoveryCodes.Set(Hash(user.UUID), &recoveryCode{hash: HashWithBytes([]byte("12345678"))}, 0)
+	if CheckRecoveryCode(user, "12345678") {
+		t.Errorf("code should be rejected after %v attempts", maxRecoveryAttempts)
+	}
+}
+
+func TestRecoveryLimit(t *testing.T) {
+	handler := RecoveryLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	post := func(ip string, UUID string) int {
+		req, _ := http.NewRequest("POST", "", strings.NewReader(url.Values{"UUID": {UUID}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// guesses for one user spread over many clients
+	UUID := RandomString(10)
+	for i := 0; i < 5; i++ {
+		if code := post("10.1.0."+strconv.Itoa(i), UUID); code != 200 {
+			t.Fatalf("Got %v expected %v", code, 200)
+		}
+	}
+	if code := post("10.1.1.1", UUID); code != 429 {
+		t.Errorf("Got %v expected %v", code, 429)
+	}
+
+	// one client guessing for many users
+	for i := 0; i < 5; i++ {
+		if code := post("10.2.0.1", RandomString(10)); code != 200 {
+			t.Fatalf("Got %v expected %v", code, 200)
+		}
+	}
+	if code := post("10.2.0.1", RandomString(10)); code != 429 {
+		t.Errorf("Got %v expected %v", code, 429)
+	}
+
+	// other clients behind the same trusted proxy are not limited
+	defer os.Setenv("trusted_proxies", os.Getenv("trusted_proxies"))
+	_ = os.Setenv("trusted_proxies", "10.2.0.1")
+	req, _ := http.NewRequest("POST", "", strings.NewReader(url.Values{"UUID": {RandomString(10)}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", "10.3.0.1")
+	req.RemoteAddr = "10.2.0.1:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Errorf("Got %v expected %v", rr.Code, 200)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	defer os.Setenv("trusted_proxies", os.Getenv("trusted_proxies"))
+	r, _ := http.NewRequest("POST", "", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 2.2.2.2, 10.0.0.2")
+	r.Header.Set("X-Real-IP", "3.3.3.3")
+
+	// the headers of clients that aren't a trusted proxy are ignored
+	_ = os.Setenv("trusted_proxies", "")
+	if ip := remoteIP(r); ip != "10.0.0.1" {
+		t.Errorf("Got %v expected %v", ip, "10.0.0.1")
+	}
+
+	// the first address that isn't a trusted proxy from the right of X-Forwarded-For is the client
+	_ = os.Setenv("trusted_proxies", "10.0.0.1, 10.0.0.2")
+	if ip := remoteIP(r); ip != "2.2.2.2" {
+		t.Errorf("Got %v expected %v", ip, "2.2.2.2")
+	}
+	r.Header.Del("X-Forwarded-For")
+	if ip := remoteIP(r); ip != "3.3.3.3" {
+		t.Errorf("Got %v expected %v", ip, "3.3.3.3")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// kinds of Signal. offer, answer and candidate are the WebRTC session descriptions and ICE candidates. failed tells
+// the other user that the direct connection could not be made so the file will be uploaded instead and complete is
+// sent by both the sender and the friend once the whole file has been received.
+const (
+	signalOffer     = "offer"
+	signalAnswer    = "answer"
+	signalCandidate = "candidate"
+	signalFailed    = "failed"
+	signalComplete  = "complete"
+)
+
+// Signal is a WebRTC signalling message relayed over the sockets of the sender and a friend so that they can send a
+// transfer directly to each other. The sender refers to the transfer returned by InitUpload and Code picks the friend
+// in a group. The friend refers to the transfer in the TransferOffer or Signal it received.
+type Signal struct {
+	TransferID int64           `json:"transfer_id"`
+	Code       string          `json:"code,omitempty"`
+	Kind       string          `json:"kind"`
+	SDP        string          `json:"sdp,omitempty"`
+	Candidate  json.RawMessage `json:"candidate,omitempty"`
+}
+
+// GetSignalTransfer fetches the transfer that user is signalling about while it has not been uploaded. fromSender is
+// true if user is the sender of the transfer.
+func GetSignalTransfer(db *sql.DB, user User, signal Signal) (transfer Transfer, fromSender bool, ok bool) {
+	var awaitingConsent bool
+	scan := func(result *sql.Row) bool {
+		err := result.Scan(&transfer.ID, &transfer.groupID, &transfer.from.UUID, &transfer.to.UUID, &transfer.to.Code,
+			&awaitingConsent)
+		return err == nil && transfer.ID > 0 && !awaitingConsent
+	}
+
+	// the sender
+	if scan(db.QueryRow(`
+	SELECT id, IFNULL(group_id, id), from_UUID, to_UUID, IFNULL(to_code, ''),
+		needs_consent = 1 AND accepted_dttm IS NULL
+	FROM transfer
+	WHERE (id = ? OR group_id = ?)
+	AND from_UUID = ?
+	AND (? = '' OR to_code = ?)
+	AND file_path IS NULL
+	AND finished_dttm IS NULL
+	ORDER BY id
+	LIMIT 1`, signal.TransferID, signal.TransferID, Hash(user.UUID), signal.Code, signal.Code)) {
+		return transfer, true, true
+	}
+
+	// the friend
+	ok = scan(db.QueryRow(`
+	SELECT id, IFNULL(group_id, id), from_UUID, to_UUID, IFNULL(to_code, ''),
+		needs_consent = 1 AND accepted_dttm IS NULL
+	FROM transfer
+	WHERE id = ?
+	AND to_UUID = ?
+	AND file_path IS NULL
+	AND finished_dttm IS NULL`, signal.TransferID, Hash(user.UUID)))
+	return transfer, false, ok
+}
+
+// CompletedDirect records that the sender or the friend says the friend received the transfer directly from the
+// sender. The transfer is only completed once both of them have said so and it does not count towards the bandwidth
+// of the sender.
+func (transfer Transfer) CompletedDirect(db *sql.DB, fromSender bool) error {
+	var confirmed bool
+	err := inTx(db, func(tx *sql.Tx) error {
+		var senderConfirmed, friendConfirmed bool
+		err := tx.QueryRow(`
+		SELECT direct_sender_confirmed, direct_friend_confirmed
+		FROM transfer
+		WHERE id = ?
+		FOR UPDATE`, transfer.ID).Scan(&senderConfirmed, &friendConfirmed)
+		if err != nil {
+			return err
+		}
+		if fromSender {
+			senderConfirmed = true
+		} else {
+			friendConfirmed = true
+		}
+		confirmed = senderConfirmed && friendConfirmed
+		_, err = tx.Exec(`
+		UPDATE transfer
+		SET direct_sender_confirmed = ?, direct_friend_confirmed = ?
+		WHERE id = ?`, senderConfirmed, friendConfirmed, transfer.ID)
+		return err
+	})
+	if err != nil || !confirmed {
+		return err
+	}
+
+	changed, err := transfer.Transition(db, StateCompleted, "received directly", func(tx *sql.Tx) error {
+		return UpdateErr(tx.Exec(`
+		UPDATE transfer
+		SET finished_dttm = NOW(), failed = 0, direct = 1
+		WHERE id = ?`, transfer.ID))
+	})
+	if err != nil || !changed {
+		return err
+	}
+	transfer.notifySender(db, false, false)
+	return nil
+}
+
+// RelaySignal sends signal from user to the other user of the transfer. The transfer is only completed once both
+// users have sent a complete signal.
+func (s *Server) RelaySignal(user User, signal Signal) error {
+	switch signal.Kind {
+	case signalOffer, signalAnswer, signalCandidate, signalFailed, signalComplete:
+	default:
+		return ErrInvalidMessage.WithMessage("Unknown signal kind " + signal.Kind)
+	}
+
+	transfer, fromSender, ok := GetSignalTransfer(s.db, user, signal)
+	if !ok {
+		return ErrTransferNotFound
+	}
+
+	to := transfer.from.UUID
+	if fromSender {
+		to = transfer.to.UUID
+		signal.TransferID = transfer.ID
+		signal.Code = ""
+	} else {
+		signal.TransferID = transfer.groupID
+		signal.Code = transfer.to.Code
+	}
+
+	if signal.Kind == signalComplete {
+		if err := transfer.CompletedDirect(s.db, fromSender); err != nil {
+			if e, ok := err.(APIError); ok {
+				return e
+			}
+			Handle(err)
+			return ErrInternal.WithMessage("Failed to complete transfer")
+		}
+	}
+
+	if !WSConns.Write(s.db, SocketMessage{Signal: &signal}, to, false) && signal.Kind != signalComplete {
+		return ErrPeerOffline
+	}
+	return nil
+}
+
+// OnlineFriends returns whether each friend with codes has a socket connected so can be sent a transfer directly
+func (s *Server) OnlineFriends(codes []string) map[string]bool {
+	online := make(map[string]bool)
+	for _, code := range codes {
+		friend := CodeToUser(s.db, code)
+		if friend.UUID == "" {
+			continue
+		}
+		var connected bool
+		Handle(s.db.QueryRow(`
+		SELECT is_connected
+		FROM user
+		WHERE UUID = ?`, Hash(friend.UUID)).Scan(&connected))
+		if !connected {
+			devices, err := GetDevices(s.db, friend.UUID)
+			Handle(err)
+			for _, device := range devices {
+				connected = connected || device.Connected
+			}
+		}
+		online[code] = connected
+	}
+	return online
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func writeSignal(t *testing.T, ws *websocket.Conn, id uint64, signal Signal) {
+	payload, _ := json.Marshal(signal)
+	writeSocketFrame(t, ws, SocketFrame{ID: id, Type: socketTypeSignal, Payload: payload})
+}
+
+func TestDirectTransfer(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	senderWs := connectDeviceWSS(header1)
+	defer senderWs.Close()
+	recipientWs := connectDeviceWSS(header2)
+	defer recipientWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	rr := postJSON(InitUploadRequest{Filesize: 100, Codes: []string{user2.Code}}, header1,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var initUpload InitUploadResponse
+	_ = json.Unmarshal(rr.Body.Bytes(), &initUpload)
+	if rr.Code != 200 || !initUpload.Online[user2.Code] {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	stats := User{UUID: user1.UUID}
+	stats.GetBandwidthLeft(s.db)
+	bandwidthLeft := stats.BandwidthLeft
+
+	// the session description of the sender is relayed to the friend
+	writeSignal(t, senderWs, 1, Signal{TransferID: initUpload.TransferID, Kind: signalOffer, SDP: "foo"})
+	var signal Signal
+	readSocketFrameType(t, recipientWs, socketTypeSignal, &signal)
+	if signal.Kind != signalOffer || signal.SDP != "foo" || signal.TransferID == 0 {
+		t.Fatalf("got %+v", signal)
+	}
+	friendTransferID := signal.TransferID
+
+	// and the answer of the friend back to the sender
+	candidate := json.RawMessage(`{"candidate":"bar","sdpMid":"0"}`)
+	writeSignal(t, recipientWs, 1, Signal{TransferID: friendTransferID, Kind: signalCandidate, Candidate: candidate})
+	readSocketFrameType(t, senderWs, socketTypeSignal, &signal)
+	if signal.Kind != signalCandidate || signal.TransferID != initUpload.TransferID || signal.Code != user2.Code ||
+		string(signal.Candidate) != string(candidate) {
+		t.Errorf("got %+v", signal)
+	}
+
+	// users can only signal about their own transfers
+	_, header3 := v1User(t)
+	strangerWs := connectDeviceWSS(header3)
+	defer strangerWs.Close()
+	writeSignal(t, strangerWs, 1, Signal{TransferID: friendTransferID, Kind: signalAnswer, SDP: "foo"})
+	var e APIError
+	readSocketFrameType(t, strangerWs, socketTypeError, &e)
+	if e.Code != ErrTransferNotFound.Code {
+		t.Errorf("got %+v", e)
+	}
+
+	// the transfer is not completed by only one of the users
+	writeSignal(t, senderWs, 2, Signal{TransferID: initUpload.TransferID, Kind: signalComplete})
+	readSocketFrameType(t, recipientWs, socketTypeSignal, &signal)
+	if signal.Kind != signalComplete {
+		t.Errorf("got %+v", signal)
+	}
+	var direct bool
+	_ = s.db.QueryRow(`SELECT direct FROM transfer WHERE id = ?`, initUpload.TransferID).Scan(&direct)
+	if direct {
+		t.Errorf("expected the transfer to wait for the friend to complete it")
+	}
+
+	// the friend also completes the transfer once the file has arrived
+	writeSignal(t, recipientWs, 2, Signal{TransferID: friendTransferID, Kind: signalComplete})
+	var message DesktopMessage
+	readSocketFrameType(t, senderWs, socketTypeMessage, &message)
+	if message.Title != "Successful Transfer" {
+		t.Errorf("got %+v", message)
+	}
+	readSocketFrameType(t, senderWs, socketTypeSignal, &signal)
+	if signal.Kind != signalComplete {
+		t.Errorf("got %+v", signal)
+	}
+	_ = s.db.QueryRow(`SELECT direct FROM transfer WHERE id = ?`, initUpload.TransferID).Scan(&direct)
+	if !direct {
+		t.Errorf("expected the transfer to be completed directly")
+	}
+	stats = User{UUID: user1.UUID}
+	stats.GetBandwidthLeft(s.db)
+	if stats.BandwidthLeft != bandwidthLeft {
+		t.Errorf("expected a direct transfer not to use bandwidth got %v", stats.BandwidthLeft)
+	}
+}
+
+func TestDirectTransferOffline(t *testing.T) {
+	_, header1 := v1User(t)
+	user2, _ := genUser()
+	senderWs := connectDeviceWSS(header1)
+	defer senderWs.Close()
+
+	rr := postJSON(InitUploadRequest{Filesize: 100, Codes: []string{user2.Code}}, header1,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var initUpload InitUploadResponse
+	_ = json.Unmarshal(rr.Body.Bytes(), &initUpload)
+	if rr.Code != 200 || initUpload.Online[user2.Code] {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// the sender falls back to uploading the file
+	writeSignal(t, senderWs, 1, Signal{TransferID: initUpload.TransferID, Kind: signalOffer, SDP: "foo"})
+	var e APIError
+	readSocketFrameType(t, senderWs, socketTypeError, &e)
+	if e.Code != ErrPeerOffline.Code {
+		t.Errorf("got %+v", e)
+	}
+}
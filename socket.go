@@ -1,11 +1,17 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // DesktopMessage structure
@@ -14,11 +20,18 @@ type DesktopMessage struct {
 	Message string `json:"message"`
 }
 
-// SocketMessage structure
+// SocketMessage is a message sent to a user over their web socket. Only one of the fields is set.
 type SocketMessage struct {
 	User     *User           `json:"user"`
 	Download *Transfer       `json:"download"`
 	Message  *DesktopMessage `json:"message"`
+	// only sent to clients using protocol v2
+	Progress *Progress      `json:"progress,omitempty"`
+	Cancel   *Cancel        `json:"cancel,omitempty"`
+	Error    *APIError      `json:"error,omitempty"`
+	Offer    *TransferOffer `json:"offer,omitempty"`
+	Answer   *OfferAnswer   `json:"answer,omitempty"`
+	Signal   *Signal        `json:"signal,omitempty"`
 }
 
 // IncomingSocketMessage structure
@@ -27,84 +40,216 @@ type IncomingSocketMessage struct {
 	Content string `json:"content"`
 }
 
-type PendingMessagesMutex struct {
-	messages map[string][]SocketMessage
-	sync.RWMutex
+// web socket protocols negotiated with the Version header
+const (
+	socketProtocolV1 = 1
+	socketProtocolV2 = 2
+)
+
+// message types of protocol v2
+const (
+	socketTypeDownloadOffer = "download-offer"
+	socketTypeProgress      = "progress"
+	socketTypeCancel        = "cancel"
+	socketTypeStats         = "stats"
+	socketTypeError         = "error"
+	socketTypeMessage       = "message"
+	socketTypeAck           = "ack"
+	socketTypeKeepAlive     = "keep-alive"
+	socketTypeTransferOffer = "transfer-offer"
+	socketTypeOfferAnswer   = "offer-answer"
+	socketTypeSignal        = "signal"
+)
+
+// SocketFrame is a message of protocol v2. Messages sent by the server have an increasing ID which the client
+// acknowledges by replying with an ack frame with Ack set to the ID. Messages that have not been acknowledged when the
+// socket closes are sent again on the next connection. Ack is also set on error frames to the ID of the client frame
+// that caused the error.
+type SocketFrame struct {
+	ID      uint64          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Ack     uint64          `json:"ack,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Progress of a transfer being uploaded or downloaded. FilePath is only known once the upload has finished.
+type Progress struct {
+	Direction   string  `json:"direction"`
+	TransferID  int64   `json:"transfer_id"`
+	FilePath    string  `json:"file_path,omitempty"`
+	Bytes       int     `json:"bytes"`
+	Size        int     `json:"size"`
+	Percent     float64 `json:"percent"`
+	BytesPerSec int     `json:"bytes_per_sec"`
+	ETASecs     int     `json:"eta_secs"`
+}
+
+// Cancel tells a user that a transfer has been cancelled. The sender is told the code of the friend that cancelled.
+type Cancel struct {
+	TransferID int64  `json:"transfer_id,omitempty"`
+	Code       string `json:"code,omitempty"`
+	FilePath   string `json:"file_path"`
+	Reason     string `json:"reason"`
+}
+
+// KeepAlive is the payload of a keep-alive frame
+type KeepAlive struct {
+	FilePath string `json:"file_path"`
+}
+
+// Type returns the protocol v2 type of the message
+func (message SocketMessage) Type() string {
+	switch {
+	case message.Download != nil:
+		return socketTypeDownloadOffer
+	case message.Progress != nil:
+		return socketTypeProgress
+	case message.Cancel != nil:
+		return socketTypeCancel
+	case message.User != nil:
+		return socketTypeStats
+	case message.Error != nil:
+		return socketTypeError
+	case message.Offer != nil:
+		return socketTypeTransferOffer
+	case message.Answer != nil:
+		return socketTypeOfferAnswer
+	case message.Signal != nil:
+		return socketTypeSignal
+	}
+	return socketTypeMessage
+}
+
+// Payload returns the field of the message that is set
+func (message SocketMessage) Payload() interface{} {
+	switch message.Type() {
+	case socketTypeDownloadOffer:
+		return message.Download
+	case socketTypeProgress:
+		return message.Progress
+	case socketTypeCancel:
+		return message.Cancel
+	case socketTypeStats:
+		return message.User
+	case socketTypeError:
+		return message.Error
+	case socketTypeTransferOffer:
+		return message.Offer
+	case socketTypeOfferAnswer:
+		return message.Answer
+	case socketTypeSignal:
+		return message.Signal
+	}
+	return message.Message
+}
+
+// IsLegacy returns true if the message can be sent with protocol v1
+func (message SocketMessage) IsLegacy() bool {
+	return message.Progress == nil && message.Cancel == nil && message.Error == nil && message.Offer == nil &&
+		message.Answer == nil && message.Signal == nil
+}
+
+// SocketProtocol returns the web socket protocol for the Version header of a client. Versions before 2 use the
+// original protocol.
+func SocketProtocol(version string) int {
+	major, err := strconv.Atoi(strings.SplitN(strings.TrimSpace(version), ".", 2)[0])
+	if err != nil || major < socketProtocolV2 {
+		return socketProtocolV1
+	}
+	return socketProtocolV2
 }
 
 type Funnel struct {
-	conn *websocket.Conn
+	conn      *websocket.Conn
+	protocol  int
+	heartbeat Heartbeat
+	// the registered device connected or empty for the device that created the account
+	device string
+	// last ID sent with protocol v2
+	seq uint64
+	// messages sent with protocol v2 waiting to be acknowledged by ID
+	unacked map[uint64]SocketMessage
 	sync.RWMutex
 }
 
 type Funnels struct {
-	conns map[string]*Funnel
+	// connections by hashed UUID and device
+	conns map[string]map[string]*Funnel
+	// connects the Funnels of every instance
+	bus Bus
 	sync.RWMutex
 }
 
 // WSConns stores all connected web sockets
-var WSConns = Funnels{make(map[string]*Funnel), sync.RWMutex{}}
-
-var PendingMessages = PendingMessagesMutex{make(map[string][]SocketMessage), sync.RWMutex{}}
+var WSConns = NewFunnels()
 
 // WSHandler is the http handler for web socket connections
 func (s *Server) WSHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		WriteError(w, r, 400, "Method not allowed")
+		WriteError(w, r, ErrInvalidMethod)
 		return
 	}
 
-	var user = User{
-		UUID:    r.Header.Get("UUID"),
-		UUIDKey: r.Header.Get("UUID-key"),
-	}
-	UUIDHash := Hash(user.UUID)
-
-	if !user.IsValid(s.db) {
-		WriteError(w, r, 401, "Invalid credentials!")
+	user, ok := UserFromContext(r)
+	if !ok {
+		WriteError(w, r, ErrInvalidCredentials)
 		return
 	}
+	UUIDHash := Hash(user.UUID)
 
 	// validate inputs
 	if !IsValidVersion(r.Header.Get("Version")) {
-		WriteError(w, r, 400, "Invalid Version")
+		WriteError(w, r, ErrInvalidVersion)
 		return
 	}
 
 	// connect to socket
 	wsconn, err := upgrader.Upgrade(w, r, nil)
-	Handle(err)
-	f := Funnel{}
-	f.conn = wsconn
+	if err != nil {
+		Handle(err)
+		return
+	}
+	f := NewFunnel(wsconn, SocketProtocol(r.Header.Get("Version")), user.DeviceID)
 
-	// add web socket connection to list of clients
-	WSConns.AddConn(UUIDHash, &f)
+	// the connection is dropped if nothing is heard from the client within the pong wait
+	Handle(f.ExtendReadDeadline())
+	wsconn.SetPongHandler(func(string) error { return f.ExtendReadDeadline() })
+	stop := make(chan struct{})
+	go f.KeepAlive(stop)
+
+	// add web socket connection to list of clients replacing any previous connection of the same device
+	if previous, ok := WSConns.AddConn(UUIDHash, f); ok {
+		previous.Close()
+	}
 
 	// mark user as connected in db
-	go user.IsConnected(s.db, true)
-
-	// write pending messages
-	PendingMessages.RLock()
-	messages, ok := PendingMessages.messages[UUIDHash]
-	PendingMessages.RUnlock()
-	if ok {
-		// send pending messages to user
-		for _, message := range messages {
-			go f.Write(message)
+	connectionID, err := Connected(s.db, user)
+	Handle(err)
+
+	// send pending messages to user
+	messages, err := PopPendingMessages(s.db, UUIDHash, f.device)
+	Handle(err)
+	for _, message := range messages {
+		if err := f.Write(message); err == errNotDeliverable {
+			// the device will never be able to receive the message
+			continue
+		} else if err != nil {
+			Handle(err)
+			Handle(StoreDevicePendingMessage(s.db, UUIDHash, f.device, message))
 		}
 	}
 
-	// delete pending socket messages
-	PendingMessages.Lock()
-	delete(PendingMessages.messages, UUIDHash)
-	PendingMessages.Unlock()
-
-	// incoming socket messages
+	// incoming socket messages until the socket is closed
 	for {
 		_, message, err := wsconn.ReadMessage()
 		if err != nil {
 			break
 		}
+		Handle(f.ExtendReadDeadline())
+		if f.protocol == socketProtocolV2 {
+			s.handleSocketFrame(f, user, message)
+			continue
+		}
 
 		var mess IncomingSocketMessage
 		Handle(json.Unmarshal(message, &mess))
@@ -112,71 +257,294 @@ func (s *Server) WSHandler(w http.ResponseWriter, r *http.Request) {
 			go KeepAliveTransfer(s.db, user, mess.Content)
 		} else if mess.Type == "stats" {
 			user.SetStats(s.db)
-			WSConns.Write(SocketMessage{
+			WSConns.Write(s.db, SocketMessage{
 				User: &user,
 			}, user.UUID, true)
 		}
-		break
 	}
 
-	// mark user as disconnected
-	go user.IsConnected(s.db, false)
+	close(stop)
+	f.Close()
+
+	// remove client from clients and mark user as disconnected unless they have a socket on any instance
+	WSConns.RemConn(UUIDHash, f)
+	if connectionID > 0 {
+		Handle(Disconnected(s.db, user, connectionID))
+	}
+
+	// keep any messages that were not acknowledged for the next connection
+	for _, message := range f.Unacked() {
+		Handle(StoreDevicePendingMessage(s.db, UUIDHash, f.device, message))
+	}
+}
+
+// handleSocketFrame handles a frame sent by a client using protocol v2
+func (s *Server) handleSocketFrame(f *Funnel, user User, message []byte) {
+	var frame SocketFrame
+	if err := json.Unmarshal(message, &frame); err != nil {
+		Handle(f.WriteError(frame, ErrInvalidMessage))
+		return
+	}
+
+	switch frame.Type {
+	case socketTypeAck:
+		f.Ack(frame.Ack)
+	case socketTypeKeepAlive:
+		var keepAlive KeepAlive
+		if err := json.Unmarshal(frame.Payload, &keepAlive); err != nil || keepAlive.FilePath == "" {
+			Handle(f.WriteError(frame, ErrInvalidMessage))
+			return
+		}
+		go KeepAliveTransfer(s.db, user, keepAlive.FilePath)
+	case socketTypeStats:
+		user.SetStats(s.db)
+		Handle(f.Write(SocketMessage{User: &user}))
+	case socketTypeCancel:
+		var req CancelRequest
+		if err := json.Unmarshal(frame.Payload, &req); err != nil {
+			Handle(f.WriteError(frame, ErrInvalidMessage))
+			return
+		}
+		if err := s.CancelTransfer(user, req); err != nil {
+			Handle(f.WriteError(frame, AsAPIError(err)))
+		}
+	case socketTypeSignal:
+		var signal Signal
+		if err := json.Unmarshal(frame.Payload, &signal); err != nil {
+			Handle(f.WriteError(frame, ErrInvalidMessage))
+			return
+		}
+		if err := s.RelaySignal(user, signal); err != nil {
+			Handle(f.WriteError(frame, AsAPIError(err)))
+		}
+	default:
+		Handle(f.WriteError(frame, ErrInvalidMessage.WithMessage("Unknown message type "+frame.Type)))
+	}
+}
+
+// NewFunnel creates a Funnel for a web socket connection of device using protocol
+func NewFunnel(conn *websocket.Conn, protocol int, device string) *Funnel {
+	return &Funnel{
+		conn:      conn,
+		protocol:  protocol,
+		heartbeat: heartbeat,
+		device:    device,
+		unacked:   make(map[uint64]SocketMessage),
+	}
+}
+
+// errNotDeliverable is returned when a message can't be sent with the protocol of a socket
+var errNotDeliverable = errors.New("message not supported by socket protocol")
+
+// Write sends message in the format of the protocol of the funnel. errNotDeliverable is returned for messages that
+// can't be represented with protocol v1.
+func (funnel *Funnel) Write(message SocketMessage) error {
+	funnel.Lock()
+	defer funnel.Unlock()
+	if funnel.protocol != socketProtocolV2 {
+		if !message.IsLegacy() {
+			return errNotDeliverable
+		}
+		return funnel.writeJSON(message)
+	}
+
+	payload, err := json.Marshal(message.Payload())
+	if err != nil {
+		return err
+	}
+	funnel.seq++
+	frame := SocketFrame{ID: funnel.seq, Type: message.Type(), Payload: payload}
+	funnel.unacked[frame.ID] = message
+	return funnel.writeJSON(frame)
+}
 
-	// remove client from clients
-	WSConns.RemConn(UUIDHash)
+// WriteError sends an error in reply to frame. Errors don't need to be acknowledged.
+func (funnel *Funnel) WriteError(frame SocketFrame, e APIError) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	funnel.Lock()
+	defer funnel.Unlock()
+	funnel.seq++
+	return funnel.writeJSON(SocketFrame{ID: funnel.seq, Type: socketTypeError, Ack: frame.ID, Payload: payload})
 }
 
-func (funnel *Funnel) Write(message interface{}) error {
-	jsonReply, err := json.Marshal(message)
+// writeJSON must be called with the funnel locked so frames are written in order of their IDs
+func (funnel *Funnel) writeJSON(v interface{}) error {
+	jsonReply, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
+	if err := funnel.conn.SetWriteDeadline(time.Now().Add(funnel.heartbeat.WriteWait)); err != nil {
+		return err
+	}
+	return funnel.conn.WriteMessage(websocket.TextMessage, jsonReply)
+}
+
+// Ack marks the message with ID as delivered
+func (funnel *Funnel) Ack(ID uint64) {
 	funnel.Lock()
-	err = funnel.conn.WriteMessage(websocket.TextMessage, jsonReply)
+	delete(funnel.unacked, ID)
 	funnel.Unlock()
-	return err
 }
 
-// Write sends a socket message to a connected UUID and stores if not connected
-func (conns *Funnels) Write(message SocketMessage, UUID string, storeOnFail bool) bool {
+// Unacked returns the messages that have not been acknowledged in the order they were sent
+func (funnel *Funnel) Unacked() []SocketMessage {
+	funnel.RLock()
+	defer funnel.RUnlock()
+	IDs := make([]uint64, 0, len(funnel.unacked))
+	for ID := range funnel.unacked {
+		IDs = append(IDs, ID)
+	}
+	sort.Slice(IDs, func(i, j int) bool { return IDs[i] < IDs[j] })
+	messages := make([]SocketMessage, 0, len(IDs))
+	for _, ID := range IDs {
+		messages = append(messages, funnel.unacked[ID])
+	}
+	return messages
+}
+
+// NewFunnels creates Funnels connected to the other instances with a LocalBus until SetBus is called
+func NewFunnels() *Funnels {
+	conns := &Funnels{conns: make(map[string]map[string]*Funnel)}
+	Handle(conns.SetBus(NewLocalBus()))
+	return conns
+}
+
+// SetBus replaces the bus used to reach the other instances. Messages published to bus are delivered to the sockets
+// held by conns.
+func (conns *Funnels) SetBus(bus Bus) error {
+	if err := bus.Subscribe(conns.deliver); err != nil {
+		return err
+	}
+	conns.Lock()
+	previous := conns.bus
+	conns.bus = bus
+	conns.Unlock()
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// Write sends a socket message to every connected device of UUID on any instance and stores it if no device is
+// connected
+func (conns *Funnels) Write(db *sql.DB, message SocketMessage, UUID string, storeOnFail bool) bool {
 	hashUUID := Hash(UUID)
 
-	socket, ok := conns.GetConn(hashUUID)
-	if ok {
-		err := socket.Write(message)
-		if err == nil {
-			// successfully sent socket message
-			return true
-		}
-		Handle(err)
-	} else {
-		log.Println("UUID not connected to socket: " + hashUUID)
+	sent := conns.publish(BusMessage{UUID: hashUUID, Message: message})
+	if sent {
+		return true
 	}
+	log.Println("UUID not connected to socket: " + hashUUID)
 
 	if storeOnFail {
-		PendingMessages.Lock()
-		PendingMessages.messages[hashUUID] = append(PendingMessages.messages[hashUUID], message)
-		PendingMessages.Unlock()
+		Handle(StorePendingMessage(db, hashUUID, message))
 	}
 
 	return false
 }
 
-func (conns *Funnels) GetConn(key string) (*Funnel, bool) {
+// WriteOthers sends a socket message to every connected device of UUID except device. It returns true if any device
+// received the message.
+func (conns *Funnels) WriteOthers(message SocketMessage, UUID string, device string) bool {
+	return conns.publish(BusMessage{UUID: Hash(UUID), Message: message, Except: true, Device: device})
+}
+
+// Disconnect closes the socket of a device of UUID on any instance
+func (conns *Funnels) Disconnect(UUID string, device string) {
+	conns.publish(BusMessage{UUID: Hash(UUID), Device: device, Disconnect: true})
+}
+
+// publish sends msg over the bus falling back to the local sockets if the bus is unavailable
+func (conns *Funnels) publish(msg BusMessage) bool {
+	msg.ID = RandomString(20)
+	conns.RLock()
+	bus := conns.bus
+	conns.RUnlock()
+	delivered, err := bus.Publish(msg)
+	if err != nil {
+		Handle(err)
+		return conns.deliver(msg)
+	}
+	return delivered
+}
+
+// deliver handles a message from the bus for the sockets held by this instance
+func (conns *Funnels) deliver(msg BusMessage) bool {
+	if msg.Disconnect {
+		socket, ok := conns.GetConn(msg.UUID, msg.Device)
+		if ok {
+			socket.Close()
+		}
+		return ok
+	}
+
+	sent := false
+	for _, socket := range conns.GetConns(msg.UUID) {
+		if msg.Except && socket.device == msg.Device {
+			continue
+		}
+		err := socket.Write(msg.Message)
+		if err == errNotDeliverable {
+			continue
+		} else if err != nil {
+			Handle(err)
+
+			// the connection is dead so stop using it and let its read loop clean up
+			conns.RemConn(msg.UUID, socket)
+			socket.Close()
+			continue
+		}
+		sent = true
+	}
+	return sent
+}
+
+// GetConns returns the connections of every device of key
+func (conns *Funnels) GetConns(key string) []*Funnel {
 	conns.RLock()
-	socket, ok := conns.conns[key]
+	defer conns.RUnlock()
+	var sockets []*Funnel
+	for _, socket := range conns.conns[key] {
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
+// GetConn returns the connection of a device of key
+func (conns *Funnels) GetConn(key string, device string) (*Funnel, bool) {
+	conns.RLock()
+	socket, ok := conns.conns[key][device]
 	conns.RUnlock()
 	return socket, ok
 }
 
-func (conns *Funnels) AddConn(key string, funnel *Funnel) {
+// AddConn adds the connection of a device of key returning the previous connection of the device if there was one
+func (conns *Funnels) AddConn(key string, funnel *Funnel) (*Funnel, bool) {
 	conns.Lock()
-	conns.conns[key] = funnel
-	conns.Unlock()
+	defer conns.Unlock()
+	if conns.conns[key] == nil {
+		conns.conns[key] = make(map[string]*Funnel)
+	}
+	previous, ok := conns.conns[key][funnel.device]
+	conns.conns[key][funnel.device] = funnel
+	return previous, ok
 }
 
-func (conns *Funnels) RemConn(key string) {
+// RemConn removes funnel as the connection of its device unless it has already been replaced by a newer connection.
+// removed is false if the device has a newer connection and last is true if no devices of key are left connected.
+func (conns *Funnels) RemConn(key string, funnel *Funnel) (removed bool, last bool) {
 	conns.Lock()
-	delete(conns.conns, key)
-	conns.Unlock()
+	defer conns.Unlock()
+	if current, ok := conns.conns[key][funnel.device]; ok && current == funnel {
+		delete(conns.conns[key], funnel.device)
+		removed = true
+	}
+	if len(conns.conns[key]) == 0 {
+		delete(conns.conns, key)
+		last = true
+	}
+	return
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func connectWSSV2(user User, form url.Values) *websocket.Conn {
+	wsheader := http.Header{}
+	wsheader.Set("UUID", form.Get("UUID"))
+	wsheader.Set("UUID-key", user.UUIDKey)
+	wsheader.Set("Version", "2.0")
+	_, _, ws, _ := connectWSSHeader(wsheader)
+	return ws
+}
+
+func readSocketFrame(t *testing.T, ws *websocket.Conn) (frame SocketFrame) {
+	_, mess, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(mess, &frame); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func writeSocketFrame(t *testing.T, ws *websocket.Conn, frame SocketFrame) {
+	if err := ws.WriteJSON(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketProtocol(t *testing.T) {
+	var versions = []struct {
+		version  string
+		protocol int
+	}{
+		{"", socketProtocolV1},
+		{"1.0.1", socketProtocolV1},
+		{"1", socketProtocolV1},
+		{"2", socketProtocolV2},
+		{"2.0", socketProtocolV2},
+		{"10.3", socketProtocolV2},
+	}
+
+	for _, tt := range versions {
+		if protocol := SocketProtocol(tt.version); protocol != tt.protocol {
+			t.Errorf("got %v, wanted %v - %v", protocol, tt.protocol, tt.version)
+		}
+	}
+}
+
+func TestSocketV2Ack(t *testing.T) {
+	user, form := genUser()
+
+	// request stats without acknowledging them
+	ws := connectWSSV2(user, form)
+	writeSocketFrame(t, ws, SocketFrame{ID: 1, Type: socketTypeStats})
+	frame := readSocketFrame(t, ws)
+	var stats User
+	_ = json.Unmarshal(frame.Payload, &stats)
+	if frame.ID != 1 || frame.Type != socketTypeStats || stats.MaxFileSize == 0 {
+		t.Errorf("got %+v", frame)
+	}
+
+	// errors reply to the frame that caused them
+	writeSocketFrame(t, ws, SocketFrame{ID: 2, Type: "foo"})
+	frame = readSocketFrame(t, ws)
+	var e APIError
+	_ = json.Unmarshal(frame.Payload, &e)
+	if frame.Type != socketTypeError || frame.Ack != 2 || e.Code != ErrInvalidMessage.Code {
+		t.Errorf("got %+v", frame)
+	}
+	_ = ws.WriteMessage(websocket.TextMessage, []byte("not json"))
+	if frame = readSocketFrame(t, ws); frame.Type != socketTypeError {
+		t.Errorf("got %+v", frame)
+	}
+	ws.Close()
+	time.Sleep(time.Millisecond * time.Duration(50))
+
+	// unacknowledged stats are sent again on the next connection
+	ws = connectWSSV2(user, form)
+	frame = readSocketFrame(t, ws)
+	if frame.ID != 1 || frame.Type != socketTypeStats {
+		t.Errorf("got %+v", frame)
+	}
+	writeSocketFrame(t, ws, SocketFrame{Type: socketTypeAck, Ack: frame.ID})
+	ws.Close()
+	time.Sleep(time.Millisecond * time.Duration(50))
+
+	// acknowledged messages are not sent again
+	ws = connectWSSV2(user, form)
+	defer ws.Close()
+	writeSocketFrame(t, ws, SocketFrame{ID: 1, Type: socketTypeKeepAlive})
+	if frame = readSocketFrame(t, ws); frame.Type != socketTypeError || frame.Ack != 1 {
+		t.Errorf("got %+v", frame)
+	}
+}
+
+func TestSocketV1(t *testing.T) {
+	user, form := genUser()
+	_, _, ws, _ := connectWSS(user, form)
+	defer ws.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	// messages added in protocol v2 are not sent to v1 clients and are stored instead of counting as sent
+	if WSConns.Write(s.db, SocketMessage{Progress: &Progress{FilePath: "foo", Bytes: 1, Size: 2}}, form.Get("UUID"), true) {
+		t.Errorf("expected message not to be sent")
+	}
+	messages, err := PopPendingMessages(s.db, Hash(form.Get("UUID")), "")
+	if err != nil || len(messages) != 1 || messages[0].Progress == nil {
+		t.Errorf("got %+v %v", messages, err)
+	}
+	WSConns.Write(s.db, SocketMessage{Message: &DesktopMessage{Title: "foo"}}, form.Get("UUID"), true)
+	message := readSocketMessage(ws)
+	if message.Message == nil || message.Message.Title != "foo" {
+		t.Errorf("got %+v", message)
+	}
+
+	// the connection stays open after the first message
+	_ = ws.WriteJSON(IncomingSocketMessage{Type: "stats"})
+	if message = readSocketMessage(ws); message.User == nil {
+		t.Errorf("got %+v", message)
+	}
+	_ = ws.WriteJSON(IncomingSocketMessage{Type: "stats"})
+	if message = readSocketMessage(ws); message.User == nil {
+		t.Errorf("got %+v", message)
+	}
+}
+
+func isConnected(t *testing.T, UUID string) (connected bool) {
+	if err := s.db.QueryRow(`SELECT is_connected FROM user WHERE UUID = ?`, Hash(UUID)).Scan(&connected); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSocketHeartbeat(t *testing.T) {
+	defer func(hb Heartbeat) { heartbeat = hb }(heartbeat)
+	heartbeat = Heartbeat{
+		PingInterval: time.Millisecond * 50,
+		PongWait:     time.Millisecond * 150,
+		WriteWait:    time.Millisecond * 50,
+	}
+
+	// a client that answers pings stays connected
+	user, form := genUser()
+	ws := connectWSSV2(user, form)
+	defer ws.Close()
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(heartbeat.PongWait * 3)
+	if _, ok := WSConns.GetConn(Hash(form.Get("UUID")), ""); !ok || !isConnected(t, form.Get("UUID")) {
+		t.Errorf("expected client to still be connected")
+	}
+
+	// a client that has gone away without closing the socket never reads the pings so never replies with a pong
+	user, form = genUser()
+	ws2 := connectWSSV2(user, form)
+	defer ws2.Close()
+	time.Sleep(time.Millisecond * 20)
+	if !isConnected(t, form.Get("UUID")) {
+		t.Errorf("expected client to be connected")
+	}
+	time.Sleep(heartbeat.PongWait * 2)
+	if _, ok := WSConns.GetConn(Hash(form.Get("UUID")), ""); ok || isConnected(t, form.Get("UUID")) {
+		t.Errorf("expected dead client to be disconnected")
+	}
+}
+
+func TestNewHeartbeat(t *testing.T) {
+	_ = os.Setenv("ws_ping_secs", "20")
+	_ = os.Setenv("ws_pong_wait_secs", "10")
+	defer os.Unsetenv("ws_ping_secs")
+	defer os.Unsetenv("ws_pong_wait_secs")
+
+	hb := NewHeartbeat()
+	if hb.PingInterval != time.Second*20 || hb.PongWait <= hb.PingInterval ||
+		hb.WriteWait != time.Second*defaultWriteWaitSecs {
+		t.Errorf("got %+v", hb)
+	}
+}
@@ -0,0 +1 @@
+drop table transfer_file;
@@ -0,0 +1,14 @@
+create table if not exists transfer_file
+(
+    id          int auto_increment
+        primary key,
+    transfer_id int                         not null,
+    path        varchar(1000)               not null,
+    file_path   varchar(1300)               not null,
+    size        int(255) unsigned default 0 not null,
+    file_hash   varchar(128)                not null,
+    uploaded    tinyint(1)        default 0 not null
+);
+
+create index transferID
+    on transfer_file (transfer_id);
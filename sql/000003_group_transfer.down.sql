@@ -0,0 +1,12 @@
+drop index groupID on transfer;
+
+drop index path on transfer;
+
+create unique index path
+    on transfer (file_path);
+
+alter table transfer
+    drop column to_code;
+
+alter table transfer
+    drop column group_id;
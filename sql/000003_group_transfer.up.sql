@@ -0,0 +1,14 @@
+alter table transfer
+    add group_id int null;
+
+alter table transfer
+    add to_code varchar(255) null;
+
+alter table transfer
+    drop index path;
+
+create index path
+    on transfer (file_path);
+
+create index groupID
+    on transfer (group_id);
@@ -0,0 +1,13 @@
+create table if not exists key_recovery
+(
+    id           int auto_increment
+        primary key,
+    UUID         varchar(255)                        not null,
+    method       varchar(20)                         not null,
+    success      tinyint(1) default 0                not null,
+    ip           varchar(255)                        null,
+    created_dttm timestamp  default CURRENT_TIMESTAMP not null
+);
+
+create index UUID
+    on key_recovery (UUID);
@@ -0,0 +1,12 @@
+create table if not exists pending_message
+(
+    id           int auto_increment
+        primary key,
+    UUID         varchar(255)                        not null,
+    dedup_key    varchar(255)                        not null,
+    message      text                                not null,
+    expiry_dttm  timestamp                           null,
+    created_dttm timestamp default CURRENT_TIMESTAMP not null,
+    constraint pending_message_dedup
+        unique (UUID, dedup_key)
+);
@@ -0,0 +1,6 @@
+alter table transfer
+    drop column device_id;
+
+drop table transfer_device;
+
+drop table device;
@@ -0,0 +1,27 @@
+create table if not exists device
+(
+    id              int auto_increment
+        primary key,
+    UUID            varchar(255)            not null,
+    device_id       varchar(255)            not null,
+    name            varchar(255) default '' not null,
+    public_key      varchar(1000)           not null,
+    is_connected    tinyint(1)   default 0  not null,
+    registered_dttm datetime                not null,
+    constraint device_UUID
+        unique (UUID, device_id)
+);
+
+create table if not exists transfer_device
+(
+    id          int auto_increment
+        primary key,
+    transfer_id int           not null,
+    device_id   varchar(255)  not null,
+    password    varchar(1000) not null,
+    constraint transfer_device_id
+        unique (transfer_id, device_id)
+);
+
+alter table transfer
+    add device_id varchar(255) null;
@@ -0,0 +1,11 @@
+alter table transfer
+    drop column offer_expiry_dttm;
+
+alter table transfer
+    drop column accepted_dttm;
+
+alter table transfer
+    drop column filename;
+
+alter table transfer
+    drop column needs_consent;
@@ -0,0 +1,11 @@
+alter table transfer
+    add needs_consent tinyint(1) default 0 not null;
+
+alter table transfer
+    add filename varchar(255) null;
+
+alter table transfer
+    add accepted_dttm datetime null;
+
+alter table transfer
+    add offer_expiry_dttm datetime null;
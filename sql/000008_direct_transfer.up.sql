@@ -0,0 +1,2 @@
+alter table transfer
+    add direct tinyint(1) default 0 not null;
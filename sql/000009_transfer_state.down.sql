@@ -0,0 +1,4 @@
+drop table transfer_event;
+
+alter table transfer
+    drop column state;
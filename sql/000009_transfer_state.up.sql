@@ -0,0 +1,26 @@
+alter table transfer
+    add state varchar(20) default 'initialised' not null;
+
+update transfer
+set state = case
+                when finished_dttm is null and file_path is null then 'initialised'
+                when finished_dttm is null then 'ready'
+                when failed = 0 then 'completed'
+                when needs_consent = 1 and accepted_dttm is null then 'declined'
+                when expiry_dttm is not null and expiry_dttm <= finished_dttm then 'expired'
+                else 'failed'
+    end;
+
+create table if not exists transfer_event
+(
+    id           int auto_increment
+        primary key,
+    transfer_id  int                                 not null,
+    from_state   varchar(20)                         not null,
+    to_state     varchar(20)                         not null,
+    reason       varchar(255)                        not null,
+    created_dttm timestamp default CURRENT_TIMESTAMP not null
+);
+
+create index transferID
+    on transfer_event (transfer_id);
@@ -0,0 +1,5 @@
+alter table transfer
+    drop column from_code;
+
+alter table transfer
+    drop column created_dttm;
@@ -0,0 +1,5 @@
+alter table transfer
+    add from_code varchar(255) null;
+
+alter table transfer
+    add created_dttm timestamp default CURRENT_TIMESTAMP not null;
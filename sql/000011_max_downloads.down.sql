@@ -0,0 +1,5 @@
+alter table transfer
+    drop column max_downloads;
+
+alter table transfer
+    drop column downloads;
@@ -0,0 +1,5 @@
+alter table transfer
+    add max_downloads int default 1 not null;
+
+alter table transfer
+    add downloads int default 0 not null;
@@ -0,0 +1,2 @@
+alter table transfer
+    drop column retention_mins;
@@ -0,0 +1,2 @@
+alter table transfer
+    add retention_mins int null;
@@ -0,0 +1,15 @@
+create table if not exists connection
+(
+    id          int auto_increment
+        primary key,
+    UUID        varchar(255)                           not null,
+    device_id   varchar(255) default ''                not null,
+    instance_id varchar(255)                           not null,
+    seen_dttm   timestamp    default CURRENT_TIMESTAMP not null
+);
+
+create index connection_UUID
+    on connection (UUID);
+
+create index connection_instance
+    on connection (instance_id);
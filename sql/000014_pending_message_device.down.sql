@@ -0,0 +1,12 @@
+delete from pending_message
+where device_id != '';
+
+alter table pending_message
+    drop index pending_message_dedup;
+
+alter table pending_message
+    add constraint pending_message_dedup
+        unique (UUID, dedup_key);
+
+alter table pending_message
+    drop column device_id;
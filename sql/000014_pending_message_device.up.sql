@@ -0,0 +1,9 @@
+alter table pending_message
+    add device_id varchar(255) default '' not null after UUID;
+
+alter table pending_message
+    drop index pending_message_dedup;
+
+alter table pending_message
+    add constraint pending_message_dedup
+        unique (UUID, device_id, dedup_key);
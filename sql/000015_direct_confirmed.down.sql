@@ -0,0 +1,4 @@
+alter table transfer
+    drop column direct_sender_confirmed;
+alter table transfer
+    drop column direct_friend_confirmed;
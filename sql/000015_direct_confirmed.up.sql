@@ -0,0 +1,4 @@
+alter table transfer
+    add direct_sender_confirmed tinyint(1) default 0 not null;
+alter table transfer
+    add direct_friend_confirmed tinyint(1) default 0 not null;
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrTooLarge is returned by StoreFile when the reader holds more than the allowed number of bytes
+var ErrTooLarge = errors.New("file too large")
+
+// ObjectInfo describes a file held in Storage
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is where transfer files are kept. Keys are slash separated paths such as Transfer.FilePath.
+// Get and Stat return an error satisfying os.IsNotExist when there is no file at key.
+type Storage interface {
+	// Put writes everything from r to key returning the number of bytes written. The file is only visible once it
+	// has been completely written.
+	Put(key string, r io.Reader) (int64, error)
+	// Get reads length bytes of the file at key starting at offset. A negative length reads to the end of the file.
+	Get(key string, offset int64, length int64) (io.ReadCloser, error)
+	Stat(key string) (ObjectInfo, error)
+	Delete(key string) error
+	// List returns all files with keys starting with prefix
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// fileStorage is the Storage used for all transfer files
+var fileStorage Storage = LocalStorage{Dir: fileStoreDirectory}
+
+// NewStorage creates the Storage chosen with the storage environment variable
+func NewStorage() Storage {
+	if os.Getenv("storage") == "s3" {
+		return NewS3Storage(
+			os.Getenv("s3_endpoint"),
+			os.Getenv("s3_region"),
+			os.Getenv("s3_bucket"),
+			os.Getenv("s3_access_key"),
+			os.Getenv("s3_secret_key"),
+		)
+	}
+	return LocalStorage{Dir: os.Getenv("file_dir")}
+}
+
+// StoreFile puts r into storage at key while hashing it. It returns the sha256 hash and the size of the file or
+// ErrTooLarge as soon as more than limit bytes have been read.
+func StoreFile(storage Storage, key string, r io.Reader, limit int) (hash string, size int, err error) {
+	hasher := sha256.New()
+	n, err := storage.Put(key, io.TeeReader(io.LimitReader(r, int64(limit)+1), hasher))
+	if err != nil {
+		return
+	}
+	if n > int64(limit) {
+		Handle(storage.Delete(key))
+		err = ErrTooLarge
+		return
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), int(n), nil
+}
+
+// DeletePrefix deletes all files in storage with keys starting with prefix
+func DeletePrefix(storage Storage, prefix string) error {
+	objects, err := storage.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := storage.Delete(object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const localTmpPrefix = ".put-"
+
+// LocalStorage stores files on the local filesystem in Dir
+type LocalStorage struct {
+	Dir string
+}
+
+func (l LocalStorage) path(key string) string {
+	// never allow a key to escape Dir
+	key = strings.TrimPrefix(path.Clean("/"+key), "/")
+	return filepath.Clean(filepath.Join(l.Dir, filepath.FromSlash(key)))
+}
+
+// Put writes to a temporary file which is renamed to key once complete
+func (l LocalStorage) Put(key string, r io.Reader) (int64, error) {
+	p := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0744); err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), localTmpPrefix)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := os.Chmod(tmp.Name(), 0744); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), p)
+}
+
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// Get opens the file at key
+func (l LocalStorage) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return limitedFile{io.LimitReader(f, length), f}, nil
+}
+
+// Stat describes the file at key
+func (l LocalStorage) Stat(key string) (ObjectInfo, error) {
+	fi, err := os.Stat(l.path(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Delete removes the file at key along with any directories left empty
+func (l LocalStorage) Delete(key string) error {
+	p := l.path(key)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	root := l.path("")
+	for dir := filepath.Dir(p); dir != root; dir = filepath.Dir(dir) {
+		if rel, err := filepath.Rel(root, dir); err != nil || strings.HasPrefix(rel, "..") {
+			break
+		}
+		if os.Remove(dir) != nil {
+			// not empty
+			break
+		}
+	}
+	return nil
+}
+
+// List walks the directory of prefix for files starting with prefix
+func (l LocalStorage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	root := l.path(prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		root = filepath.Dir(root)
+	}
+	base := l.path("")
+
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), localTmpPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		return nil
+	})
+	return objects, err
+}
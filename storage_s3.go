@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service         = "s3"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+)
+
+// S3Storage stores files in a bucket of an S3 compatible object store such as MinIO. Requests use path style
+// addressing and are signed with AWS signature version 4.
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	client    *http.Client
+}
+
+// NewS3Storage creates a S3Storage for bucket at endpoint (e.g https://s3.eu-west-2.amazonaws.com)
+func NewS3Storage(endpoint, region, bucket, accessKey, secretKey string) *S3Storage {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Storage{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		client:    &http.Client{},
+	}
+}
+
+// s3Error is the error body returned by S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Storage) objectURL(key string) string {
+	return s.Endpoint + "/" + s.Bucket + "/" + s3Escape(strings.TrimPrefix(key, "/"), false)
+}
+
+// Put spools r to a temporary file as S3 requires the Content-Length of an object up front
+func (s *S3Storage) Put(key string, r io.Reader) (int64, error) {
+	tmp, err := ioutil.TempFile("", "s3-put-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return n, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return n, err
+	}
+
+	req, err := http.NewRequest("PUT", s.objectURL(key), ioutil.NopCloser(tmp))
+	if err != nil {
+		return n, err
+	}
+	req.ContentLength = n
+	res, err := s.do(req)
+	if err != nil {
+		return n, err
+	}
+	return n, res.Body.Close()
+}
+
+// Get requests a range of the object at key
+func (s *S3Storage) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	req, err := http.NewRequest("GET", s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Stat requests the head of the object at key
+func (s *S3Storage) Stat(key string) (ObjectInfo, error) {
+	req, err := http.NewRequest("HEAD", s.objectURL(key), nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	Handle(res.Body.Close())
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: res.ContentLength, ModTime: modTime}, nil
+}
+
+// Delete removes the object at key
+func (s *S3Storage) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// List pages through all the objects in the bucket starting with prefix
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var (
+		objects []ObjectInfo
+		token   string
+	)
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest("GET", s.Endpoint+"/"+s.Bucket+"?"+s3Query(query), nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var list s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&list)
+		Handle(res.Body.Close())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range list.Contents {
+			objects = append(objects, ObjectInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified})
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+// do signs and sends req returning an error for any unsuccessful response. A 404 response returns os.ErrNotExist.
+func (s *S3Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	var e s3Error
+	_ = xml.NewDecoder(res.Body).Decode(&e)
+	return nil, fmt.Errorf("s3 %s %s: %d %s %s", req.Method, req.URL.Path, res.StatusCode, e.Code, e.Message)
+}
+
+// sign adds an AWS signature version 4 Authorization header to req
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format(s3TimeFormat)
+	date := now.Format(s3DateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key := range req.Header {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(key))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.Region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := hmacSum([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSum(key, s.Region)
+	key = hmacSum(key, s3Service)
+	key = hmacSum(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSum(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape URI encodes str as required by signature version 4
+func s3Escape(str string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(str) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes a sorted query string as required by signature version 4
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal in memory S3 compatible server
+type fakeS3 struct {
+	objects map[string][]byte
+	sync.Mutex
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(403)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 {
+		// list bucket
+		var keys []string
+		for key := range f.objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var list s3ListResult
+		for _, key := range keys {
+			list.Contents = append(list.Contents, struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			}{key, int64(len(f.objects[key])), time.Now()})
+		}
+		_ = xml.NewEncoder(w).Encode(list)
+		return
+	}
+
+	key := parts[1]
+	object, ok := f.objects[key]
+	switch r.Method {
+	case "PUT":
+		f.objects[key], _ = ioutil.ReadAll(r.Body)
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(204)
+	case "GET", "HEAD":
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(object)))
+		if start, end, ok := ParseRange(r.Header.Get("Range"), int64(len(object))); ok {
+			object = object[start : end+1]
+			w.Header().Set("Content-Length", fmt.Sprint(len(object)))
+			w.WriteHeader(206)
+		}
+		if r.Method == "GET" {
+			_, _ = w.Write(object)
+		}
+	}
+}
+
+func testStorage(t *testing.T, storage Storage) {
+	key := RandomString(userDirLen) + "/foo.bar"
+
+	if _, err := storage.Stat(key); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error got %v", err)
+	}
+
+	n, err := storage.Put(key, strings.NewReader("0123456789"))
+	if err != nil || n != 10 {
+		t.Fatalf("got %v %v", n, err)
+	}
+
+	info, err := storage.Stat(key)
+	if err != nil || info.Size != 10 {
+		t.Errorf("got %v %v", info, err)
+	}
+
+	r, err := storage.Get(key, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(b) != "234" {
+		t.Errorf("got %s wanted %s", b, "234")
+	}
+
+	objects, err := storage.List(key[:userDirLen+1])
+	if err != nil || len(objects) != 1 || objects[0].Key != key {
+		t.Errorf("got %v %v", objects, err)
+	}
+
+	hash, size, err := StoreFile(storage, key, strings.NewReader("too large"), 5)
+	if err != ErrTooLarge || hash != "" || size != 0 {
+		t.Errorf("got %v %v %v", hash, size, err)
+	}
+	if _, err := storage.Stat(key); !os.IsNotExist(err) {
+		t.Errorf("expected too large file to be deleted got %v", err)
+	}
+
+	hash, size, err = StoreFile(storage, key, strings.NewReader("0123456789"), 10)
+	if err != nil || hash != HashWithBytes([]byte("0123456789")) || size != 10 {
+		t.Errorf("got %v %v %v", hash, size, err)
+	}
+
+	if err := DeletePrefix(storage, key[:userDirLen+1]); err != nil {
+		t.Error(err)
+	}
+	if _, err := storage.Stat(key); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error got %v", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(dir)
+	testStorage(t, LocalStorage{Dir: dir})
+
+	// keys should never escape the storage directory
+	if p := (LocalStorage{Dir: dir}).path("../../etc/passwd"); p != dir+"/etc/passwd" {
+		t.Errorf("got %v", p)
+	}
+
+	// an empty prefix lists everything in the storage directory and nothing beside it
+	storage := LocalStorage{Dir: filepath.Join(dir, "files")}
+	_ = ioutil.WriteFile(filepath.Join(dir, "outside"), []byte("foo"), 0600)
+	for _, key := range []string{"a", "b/c"} {
+		if _, err := storage.Put(key, strings.NewReader("foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := storage.List("")
+	if err != nil || len(objects) != 2 || objects[0].Key != "a" || objects[1].Key != "b/c" {
+		t.Errorf("got %v %v", objects, err)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: make(map[string][]byte)})
+	defer server.Close()
+	testStorage(t, NewS3Storage(server.URL, "", "bucket", "key", "secret"))
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,33 +18,238 @@ const (
 
 	creditSteps = 0.5
 	userDirLen  = 50
+
+	maxGroupRecipients  = 10
+	groupPasswordPrefix = "password_"
+
+	maxTransferDownloads = 10
 )
 
 var fileStoreDirectory = os.Getenv("file_dir")
 
 // Transfer structure
 type Transfer struct {
-	ID       int64     `json:"-"`
-	FilePath string    `json:"file_path"`
-	Size     int       `json:"file_size"`
-	from     User      `json:"-"`
-	to       User      `json:"-"`
-	hash     string    `json:"-"`
-	password string    `json:"-"`
-	expiry   time.Time `json:"-"`
+	ID           int64          `json:"transfer_id,omitempty"`
+	FilePath     string         `json:"file_path"`
+	Size         int            `json:"file_size"`
+	Files        []TransferFile `json:"files,omitempty"`
+	MaxDownloads int            `json:"max_downloads,omitempty"`
+	Expiry       time.Time      `json:"expiry"`
+	from         User           `json:"-"`
+	to           User           `json:"-"`
+	hash         string         `json:"-"`
+	password     string         `json:"-"`
+	downloads    int            `json:"-"`
+
+	// transfers sent to multiple friends share the ID of the first transfer of the group
+	groupID int64
+	// minutes the file is kept for once uploaded as chosen by the sender
+	retentionMins int
+	// passwords of each friend in a group by code
+	passwords map[string]string
+	// passwords encrypted for each registered device of the friends by device ID
+	devicePasswords map[string]string
+}
+
+// TransferState is the stage of its lifecycle that a transfer is in
+type TransferState string
+
+// states of a transfer. completed, declined, cancelled, expired and failed are final.
+const (
+	StateInitialised TransferState = "initialised"
+	StateUploading   TransferState = "uploading"
+	StateReady       TransferState = "ready"
+	StateDownloading TransferState = "downloading"
+	StateCompleted   TransferState = "completed"
+	StateDeclined    TransferState = "declined"
+	StateCancelled   TransferState = "cancelled"
+	StateExpired     TransferState = "expired"
+	StateFailed      TransferState = "failed"
+)
+
+// transferTransitions are the states that a transfer can legally move to from each state. A transfer sent directly
+// is completed without being uploaded and a transfer that can be downloaded again is ready once downloaded.
+var transferTransitions = map[TransferState][]TransferState{
+	StateInitialised: {StateUploading, StateCompleted, StateDeclined, StateCancelled, StateExpired, StateFailed},
+	StateUploading:   {StateReady, StateCancelled, StateExpired, StateFailed},
+	StateReady:       {StateDownloading, StateCompleted, StateCancelled, StateExpired, StateFailed},
+	StateDownloading: {StateReady, StateCompleted, StateCancelled, StateExpired, StateFailed},
+}
+
+// CanTransition returns true if a transfer can move from state to next
+func (state TransferState) CanTransition(next TransferState) bool {
+	for _, s := range transferTransitions[state] {
+		if s == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransferEvent is a recorded transition of a transfer from one state to another
+type TransferEvent struct {
+	From   TransferState `json:"from"`
+	To     TransferState `json:"to"`
+	Reason string        `json:"reason"`
+	Time   time.Time     `json:"time"`
+}
+
+// Transition moves the transfer to state and records why in the transfer_event table. update is run in the same
+// transaction as the transition so that the other columns of the transfer always agree with its state and can be
+// nil. Moving a transfer to the state it is already in does nothing and returns false and an illegal transition
+// returns ErrIllegalTransition.
+func (transfer Transfer) Transition(db *sql.DB, state TransferState, reason string,
+	update func(tx *sql.Tx) error) (changed bool, err error) {
+	err = inTx(db, func(tx *sql.Tx) error {
+		var err error
+		changed, err = transfer.transitionTx(tx, state, reason)
+		if err != nil || !changed || update == nil {
+			return err
+		}
+		return update(tx)
+	})
+	return changed && err == nil, err
+}
+
+// isIllegalTransition returns true if err was returned for a transition that is not allowed
+func isIllegalTransition(err error) bool {
+	e, ok := err.(APIError)
+	return ok && e.Code == ErrIllegalTransition.Code
+}
+
+// transitionTx moves the transfer to state within tx. The transfer is locked until tx ends so that concurrent
+// transitions of the same transfer happen one after the other.
+func (transfer Transfer) transitionTx(tx *sql.Tx, state TransferState, reason string) (bool, error) {
+	var from TransferState
+	err := tx.QueryRow(`
+	SELECT state
+	FROM transfer
+	WHERE id = ?
+	FOR UPDATE`, transfer.ID).Scan(&from)
+	if err != nil {
+		return false, err
+	}
+	if from == state {
+		return false, nil
+	}
+	if !from.CanTransition(state) {
+		return false, ErrIllegalTransition.WithMessage("Can't move a transfer that is " + string(from) + " to " +
+			string(state))
+	}
+
+	if _, err := tx.Exec(`
+	UPDATE transfer
+	SET state = ?
+	WHERE id = ?`, state, transfer.ID); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO transfer_event (transfer_id, from_state, to_state, reason)
+	VALUES (?, ?, ?, ?)`, transfer.ID, from, state, reason)
+	return err == nil, err
+}
+
+// GetTransferEvents fetches every transition of the transfer with ID in the order they happened
+func GetTransferEvents(db *sql.DB, ID int64) ([]TransferEvent, error) {
+	rows, err := db.Query(`
+	SELECT from_state, to_state, reason, created_dttm
+	FROM transfer_event
+	WHERE transfer_id = ?
+	ORDER BY id`, ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []TransferEvent{}
+	for rows.Next() {
+		var event TransferEvent
+		if err := rows.Scan(&event.From, &event.To, &event.Reason, &event.Time); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
 }
 
 // GetPasswordAndUUID fetches the password for the transfer and the UUID of the sending user
-// based on the UUID of the destination user the filepath of the transfer and the file hash
+// based on the UUID of the destination user the filepath of the transfer and the file hash. A registered device of the
+// destination user gets the password that was encrypted for it if there is one.
 func (transfer *Transfer) GetPasswordAndUUID(db *sql.DB) {
 	result := db.QueryRow(`
-	SELECT password, from_UUID
+	SELECT t.id, t.password, t.from_UUID, IFNULL(d.password, '')
+	FROM transfer t
+	LEFT JOIN transfer_device d ON d.transfer_id = t.id AND d.device_id = ?
+	WHERE t.finished_dttm IS NULL
+	AND t.to_UUID = ?
+	AND t.file_path = ?
+	AND t.file_hash = ?`, transfer.to.DeviceID, Hash(transfer.to.UUID), transfer.FilePath, transfer.hash)
+	var devicePassword string
+	Handle(result.Scan(&transfer.ID, &transfer.password, &transfer.from.UUID, &devicePassword))
+	if devicePassword != "" {
+		transfer.password = devicePassword
+	}
+}
+
+// StoreDevicePasswords stores the passwords that were encrypted for the registered devices of the friend
+func (transfer Transfer) StoreDevicePasswords(db *sql.DB) error {
+	if len(transfer.devicePasswords) == 0 {
+		return nil
+	}
+	devices, err := GetDevices(db, transfer.to.UUID)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		password, ok := transfer.devicePasswords[device.ID]
+		if !ok {
+			continue
+		}
+		if _, err := db.Exec(`
+		INSERT INTO transfer_device (transfer_id, device_id, password)
+		VALUES (?, ?, ?)`, transfer.ID, device.ID, password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Claim assigns the transfer to the device of user that is downloading it so that the other devices of the account
+// can no longer download it. ok is false if another device has already claimed the transfer and first is true if
+// this device has just claimed it. A transfer that can be downloaded more than once is never claimed so that it can
+// be downloaded on every device.
+func (transfer Transfer) Claim(db *sql.DB, user User) (first bool, ok bool) {
+	res, err := db.Exec(`
+	UPDATE transfer
+	SET device_id = ?
+	WHERE to_UUID = ?
+	AND file_path = ?
+	AND finished_dttm IS NULL
+	AND device_id IS NULL
+	AND max_downloads = 1`, user.DeviceID, Hash(user.UUID), transfer.FilePath)
+	if err != nil {
+		Handle(err)
+		return false, false
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return true, true
+	}
+
+	var (
+		device       sql.NullString
+		maxDownloads int
+	)
+	err = db.QueryRow(`
+	SELECT device_id, max_downloads
 	FROM transfer
-	WHERE finished_dttm IS NULL
-	AND to_UUID = ?
+	WHERE to_UUID = ?
 	AND file_path = ?
-	AND file_hash = ?`, Hash(transfer.to.UUID), transfer.FilePath, transfer.hash)
-	Handle(result.Scan(&transfer.password, &transfer.from.UUID))
+	AND finished_dttm IS NULL`, Hash(user.UUID), transfer.FilePath).Scan(&device, &maxDownloads)
+	if err == sql.ErrNoRows {
+		// nothing to claim
+		return false, true
+	}
+	return false, err == nil && (maxDownloads > 1 || device.String == user.DeviceID)
 }
 
 // AlreadyToUser returns true if already transferring between two users
@@ -58,23 +265,164 @@ func (transfer *Transfer) AlreadyToUser(db *sql.DB) bool {
 	return id > 0
 }
 
-// InitialStore stores the from_UUID and to_UUID in the transfer table as placeholders
+// InitialStore stores the from_UUID, from_code, to_UUID, to_code, expected size, max downloads and retention in the
+// transfer table as placeholders. The transfer has no expiry until it has been uploaded.
 func (transfer Transfer) InitialStore(db *sql.DB) int64 {
+	groupID := sql.NullInt64{Int64: transfer.groupID, Valid: transfer.groupID > 0}
 	res, err := db.Exec(`
-	INSERT into transfer (from_UUID, to_UUID)
-	VALUES (?, ?)`, Hash(transfer.from.UUID), Hash(transfer.to.UUID))
+	INSERT into transfer (from_UUID, from_code, to_UUID, to_code, size, group_id, max_downloads, retention_mins,
+		expiry_dttm)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULL)`, Hash(transfer.from.UUID), transfer.from.Code, Hash(transfer.to.UUID),
+		transfer.to.Code, transfer.Size, groupID, transfer.MaxDownloads, transfer.retentionMins)
 	Handle(err)
 	ID, err := res.LastInsertId()
 	Handle(err)
 	return ID
 }
 
-// Store stores the full information of the transfer based on the ID from InitialStore
-func (transfer Transfer) Store(db *sql.DB) error {
-	return UpdateErr(db.Exec(`
+// Store stores the full information of the transfer based on the ID from InitialStore within tx
+func (transfer Transfer) Store(tx *sql.Tx) error {
+	return UpdateErr(tx.Exec(`
 	UPDATE transfer 
 	SET size=?, file_hash=?, file_path=?, password=?, expiry_dttm=?, updated_dttm=NOW()
-	WHERE id=?`, transfer.Size, transfer.hash, transfer.FilePath, transfer.password, transfer.expiry, transfer.ID))
+	WHERE id=?`, transfer.Size, transfer.hash, transfer.FilePath, transfer.password, transfer.Expiry, transfer.ID))
+}
+
+// StoreGroupID stores the group of the transfer
+func (transfer Transfer) StoreGroupID(db *sql.DB) error {
+	return UpdateErr(db.Exec(`
+	UPDATE transfer
+	SET group_id=?
+	WHERE id=?`, transfer.groupID, transfer.ID))
+}
+
+// GetGroup fetches every unfinished transfer of a group by the ID of the first transfer in the group. A transfer to
+// a single friend is a group of one.
+func (transfer Transfer) GetGroup(db *sql.DB) ([]Transfer, error) {
+	rows, err := db.Query(`
+	SELECT id, to_UUID, IFNULL(to_code, ''), max_downloads, IFNULL(retention_mins, 0)
+	FROM transfer
+	WHERE (id = ? OR group_id = ?)
+	AND finished_dttm IS NULL
+	ORDER BY id`, transfer.ID, transfer.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var group []Transfer
+	for rows.Next() {
+		member := transfer
+		if err := rows.Scan(&member.ID, &member.to.UUID, &member.to.Code, &member.MaxDownloads,
+			&member.retentionMins); err != nil {
+			return nil, err
+		}
+		group = append(group, member)
+	}
+	return group, rows.Err()
+}
+
+// SetPassword sets the password from the form value name. Either "password" for every friend,
+// groupPasswordPrefix followed by the code of a friend in a group or devicePasswordPrefix followed by the ID of a
+// registered device of a friend.
+func (transfer *Transfer) SetPassword(name string, password string) {
+	if name == "password" {
+		transfer.password = password
+		return
+	}
+	if strings.HasPrefix(name, devicePasswordPrefix) {
+		if transfer.devicePasswords == nil {
+			transfer.devicePasswords = make(map[string]string)
+		}
+		transfer.devicePasswords[strings.TrimPrefix(name, devicePasswordPrefix)] = password
+		return
+	}
+	if transfer.passwords == nil {
+		transfer.passwords = make(map[string]string)
+	}
+	transfer.passwords[strings.TrimPrefix(name, groupPasswordPrefix)] = password
+}
+
+// GetUploadingTransfer fetches a transfer that has been initialised by user but has not yet had a file uploaded. The
+// first transfer of a group can be finished by its friend declining the offer as long as another friend has not.
+func GetUploadingTransfer(db *sql.DB, user User, ID int64) (transfer Transfer, ok bool) {
+	result := db.QueryRow(`
+	SELECT id, from_UUID, to_UUID, size
+	FROM transfer
+	WHERE id = ?
+	AND from_UUID = ?
+	AND file_path IS NULL`, ID, Hash(user.UUID))
+	err := result.Scan(&transfer.ID, &transfer.from.UUID, &transfer.to.UUID, &transfer.Size)
+	if err != nil || transfer.ID == 0 {
+		return transfer, false
+	}
+	group, err := transfer.GetGroup(db)
+	Handle(err)
+	return transfer, len(group) > 0
+}
+
+// Uploading moves every transfer of the group to uploading once the sender starts sending the file. It returns
+// ErrTransferNotFound once every friend of the group has cancelled.
+func (transfer Transfer) Uploading(db *sql.DB) error {
+	group, err := transfer.GetGroup(db)
+	if err != nil {
+		return err
+	}
+	uploading := 0
+	for _, member := range group {
+		if _, err := member.Transition(db, StateUploading, "upload started", nil); isIllegalTransition(err) {
+			// cancelled since the group was fetched
+			continue
+		} else if err != nil {
+			return err
+		}
+		uploading++
+	}
+	if uploading == 0 {
+		return ErrTransferNotFound
+	}
+	return nil
+}
+
+// Uploaded stores the full information of an uploaded transfer and tells every recipient to download the file. The
+// file is kept for the retention chosen by the sender from now. It returns ErrTransferNotFound if no friend of the
+// group is waiting for the file anymore in which case the file should be deleted.
+func (transfer Transfer) Uploaded(db *sql.DB) error {
+	group, err := transfer.GetGroup(db)
+	if err != nil {
+		return err
+	}
+
+	uploaded := 0
+	for _, member := range group {
+		if member.retentionMins <= 0 {
+			member.retentionMins = defaultRetentionMins
+		}
+		member.Expiry = time.Now().Add(time.Minute * time.Duration(member.retentionMins))
+		if password, ok := transfer.passwords[member.to.Code]; ok {
+			member.password = password
+		}
+		changed, err := member.Transition(db, StateReady, "uploaded", member.Store)
+		if isIllegalTransition(err) || (err == nil && !changed) {
+			// cancelled since the group was fetched
+			continue
+		} else if err != nil {
+			return err
+		}
+		uploaded++
+		if err := member.StoreDevicePasswords(db); err != nil {
+			return err
+		}
+
+		// tell friend to download file
+		WSConns.Write(db, SocketMessage{
+			Download: &member,
+		}, member.to.UUID, true)
+	}
+	if uploaded == 0 {
+		return ErrTransferNotFound
+	}
+	return nil
 }
 
 // KeepAliveTransfer will update the updated_dttm of the transfer to prevent the cleanup CleanExpiredTransfers()
@@ -84,22 +432,138 @@ func KeepAliveTransfer(db *sql.DB, user User, path string) {
 	UPDATE transfer 
 	SET updated_dttm=NOW()
 	WHERE file_path=?
-	AND to_UUID
-	OR from_UUID`, path, Hash(user.UUID), Hash(user.UUID))))
+	AND (to_UUID=? OR from_UUID=?)`, path, Hash(user.UUID), Hash(user.UUID))))
 }
 
-// Completed will mark a transfer as completed and return the state back to the user over socket message.
+// Completed will mark a transfer as completed and return the state back to the user over socket message. A transfer
+// that the friend can download again is only finished once it has been downloaded MaxDownloads times or expires.
 func (transfer Transfer) Completed(db *sql.DB, failed bool, expired bool) {
-	err := UpdateErr(db.Exec(`
-	UPDATE transfer 
-	SET file_path = NULL, finished_dttm = NOW(), password = NULL, failed = ?
+	rows, err := db.Query(`
+	SELECT id, downloads, max_downloads
+	FROM transfer
 	WHERE from_UUID = ?
 	AND to_UUID = ?
-	AND file_path = ?`, failed, Hash(transfer.from.UUID), Hash(transfer.to.UUID), transfer.FilePath))
-	Handle(err)
+	AND file_path = ?`, Hash(transfer.from.UUID), Hash(transfer.to.UUID), transfer.FilePath)
+	if err != nil {
+		Handle(err)
+		return
+	}
+	var members []Transfer
+	for rows.Next() {
+		member := transfer
+		Handle(rows.Scan(&member.ID, &member.downloads, &member.MaxDownloads))
+		members = append(members, member)
+	}
+	rows.Close()
+
+	downloadsLeft, downloadedAll, finished := false, true, 0
+	for _, member := range members {
+		if !failed && !expired {
+			last, err := member.downloaded(db)
+			if err != nil {
+				Handle(err)
+			} else if last {
+				finished++
+			} else {
+				// the friend can download the file again
+				downloadsLeft = true
+			}
+			continue
+		}
+
+		memberFailed, memberExpired := failed, expired
+		if expired && member.downloads > 0 {
+			// the friend downloaded the file but not as many times as they could have
+			memberFailed, memberExpired = false, false
+		}
+		state, reason := StateCompleted, fmt.Sprintf("downloaded %d of %d times", member.downloads, member.MaxDownloads)
+		if memberExpired {
+			state, reason = StateExpired, "not downloaded in time"
+		} else if memberFailed {
+			state, reason = StateFailed, "not downloaded"
+		}
+		changed, err := member.Transition(db, state, reason, func(tx *sql.Tx) error {
+			return UpdateErr(tx.Exec(`
+			UPDATE transfer
+			SET file_path = NULL, finished_dttm = NOW(), password = NULL, failed = ?
+			WHERE id = ?`, memberFailed, member.ID))
+		})
+		if err != nil || !changed {
+			Handle(err)
+			continue
+		}
+		finished++
+		downloadedAll = downloadedAll && !memberFailed && !memberExpired
+	}
 
-	go deleteUploadDir(transfer.FilePath)
+	if downloadsLeft {
+		WSConns.Write(db, SocketMessage{Message: &DesktopMessage{
+			Title:   "Downloaded Transfer",
+			Message: "Your friend has downloaded your file!",
+		}}, transfer.from.UUID, true)
+		return
+	}
+
+	// an offer that was never delivered is no longer of use
+	Handle(DeletePendingMessage(db, transfer.to.UUID, SocketMessage{Download: &transfer}.DedupKey()))
+
+	// the file is only deleted once every friend in a group has finished with it
+	if !fileInUse(db, transfer.FilePath) {
+		deleteUploadDir(transfer.FilePath)
+	}
+
+	// the sender is only told that an expired transfer succeeded if every friend downloaded it
+	if finished > 0 && downloadedAll {
+		failed, expired = false, false
+	}
+	transfer.notifySender(db, failed, expired)
+}
+
+// downloaded counts a download of the transfer by the friend. The transfer is ready to be downloaded again until it
+// has been downloaded MaxDownloads times when it is completed and last is true. The count and the transition happen
+// in one transaction so that devices finishing at the same time can't download the transfer more than MaxDownloads
+// times.
+func (transfer Transfer) downloaded(db *sql.DB) (last bool, err error) {
+	err = inTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`
+		UPDATE transfer
+		SET downloads = downloads + 1
+		WHERE id = ?
+		AND downloads < max_downloads`, transfer.ID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrIllegalTransition.WithMessage("The transfer has already been downloaded as many times as it can be")
+		}
+		err = tx.QueryRow(`
+		SELECT downloads, max_downloads
+		FROM transfer
+		WHERE id = ?`, transfer.ID).Scan(&transfer.downloads, &transfer.MaxDownloads)
+		if err != nil {
+			return err
+		}
 
+		last = transfer.downloads >= transfer.MaxDownloads
+		state, reason := StateReady, fmt.Sprintf("downloaded %d of %d times", transfer.downloads, transfer.MaxDownloads)
+		if last {
+			state = StateCompleted
+		}
+		if _, err := transfer.transitionTx(tx, state, reason); err != nil || !last {
+			return err
+		}
+		return UpdateErr(tx.Exec(`
+		UPDATE transfer
+		SET file_path = NULL, finished_dttm = NOW(), password = NULL, failed = 0
+		WHERE id = ?`, transfer.ID))
+	})
+	return last && err == nil, err
+}
+
+// notifySender tells the sender how the transfer finished
+func (transfer Transfer) notifySender(db *sql.DB, failed bool, expired bool) {
 	message := DesktopMessage{}
 	if expired {
 		message.Title = "Expired Transfer!"
@@ -114,63 +578,97 @@ func (transfer Transfer) Completed(db *sql.DB, failed bool, expired bool) {
 		// send user stats update to sender
 		fromUser := User{UUID: transfer.from.UUID}
 		fromUser.SetStats(db)
-		WSConns.Write(SocketMessage{
+		WSConns.Write(db, SocketMessage{
 			User: &fromUser,
 		}, transfer.from.UUID, true)
 	}
 
-	WSConns.Write(SocketMessage{Message: &message}, transfer.from.UUID, true)
+	WSConns.Write(db, SocketMessage{Message: &message}, transfer.from.UUID, true)
 }
 
-// AllowedToDownload verifies that the download request is legitimate
-func AllowedToDownload(db *sql.DB, user User, filePath string) bool {
-	var id int
+// AllowedToDownload verifies that the download request is legitimate and returns the transfer being downloaded
+func AllowedToDownload(db *sql.DB, user User, filePath string) (transfer Transfer, ok bool) {
+	var hash sql.NullString
 	result := db.QueryRow(`
-	SELECT id
+	SELECT id, IFNULL(group_id, id), file_hash, from_UUID, size
     FROM transfer
 	WHERE to_UUID = ?
 	AND file_path = ?
     AND finished_dttm IS NULL`, Hash(user.UUID), filePath)
-	_ = result.Scan(&id)
-	if id > 0 {
-		return true
-	}
-	return false
+	_ = result.Scan(&transfer.ID, &transfer.groupID, &hash, &transfer.from.UUID, &transfer.Size)
+	transfer.FilePath = filePath
+	transfer.hash = hash.String
+	return transfer, transfer.ID > 0
 }
 
 // CleanExpiredTransfers removes transfers which have exceeded the length of time they are allowed to be hosted on the
 // server
 func (s *Server) CleanExpiredTransfers() {
-	// find and remove all expired uploads
-	rows, err := s.db.Query(`
+	expireTransfers(s.db)
+	expireOffers(s.db)
+	cleanStaleChunks()
+	cleanExpiredMessages(s.db)
+	cleanTransferHistory(s.db)
+	refreshConnections(s.db)
+}
+
+// expireTransfers finishes the uploaded transfers that were not downloaded before their expiry. Transfers that are
+// still being uploaded or waiting for consent have no file and are left alone.
+func expireTransfers(db *sql.DB) {
+	rows, err := db.Query(`
 	SELECT id, file_path, to_UUID, from_UUID
 	FROM transfer
 	WHERE finished_dttm IS NULL
+	AND file_path IS NOT NULL
 	AND expiry_dttm IS NOT NULL
 	AND expiry_dttm < NOW()
-	AND (updated_dttm IS NULL OR updated_dttm + interval 1 minute > NOW())`)
-	Handle(err)
+	AND (updated_dttm IS NULL OR updated_dttm + interval 1 minute < NOW())`)
+	if err != nil {
+		Handle(err)
+		return
+	}
 
 	cnt := 0
 	for rows.Next() {
-		var transfer Transfer
-		err := rows.Scan(&transfer.ID, &transfer.FilePath, &transfer.to.UUID, &transfer.from.UUID)
-		Handle(err)
-		go transfer.Completed(s.db, true, true)
+		var (
+			transfer Transfer
+			filePath sql.NullString
+		)
+		if err := rows.Scan(&transfer.ID, &filePath, &transfer.to.UUID, &transfer.from.UUID); err != nil {
+			Handle(err)
+			continue
+		}
+		transfer.FilePath = filePath.String
+		go transfer.Completed(db, true, true)
 		cnt += 1
 	}
-	rows.Close()
+	Handle(rows.Close())
 
 	if cnt > 0 {
 		log.Println("Deleted " + strconv.Itoa(cnt) + " transfers")
 	}
 }
 
+// fileInUse returns true if there is an unfinished transfer of the file at filePath
+func fileInUse(db *sql.DB, filePath string) bool {
+	var id int64
+	result := db.QueryRow(`
+	SELECT id
+	FROM transfer
+	WHERE file_path = ?
+	AND finished_dttm IS NULL
+	LIMIT 1`, filePath)
+	_ = result.Scan(&id)
+	return id > 0
+}
+
+// deleteUploadDir deletes the directory of filePath from fileStorage
 func deleteUploadDir(filePath string) bool {
-	dir := path.Dir(fileStoreDirectory + filePath)
-	if err := os.RemoveAll(dir); err != nil {
-		Handle(err)
-		err = os.Remove(dir)
+	dir := path.Dir(filePath)
+	if filePath == "" || dir == "." || dir == "/" {
+		return false
+	}
+	if err := DeletePrefix(fileStorage, dir+"/"); err != nil {
 		Handle(err)
 		return false
 	}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTransferStateCanTransition(t *testing.T) {
+	var tests = []struct {
+		from, to TransferState
+		ok       bool
+	}{
+		{StateInitialised, StateUploading, true},
+		{StateInitialised, StateReady, false},
+		{StateInitialised, StateCompleted, true},
+		{StateUploading, StateReady, true},
+		{StateReady, StateDownloading, true},
+		{StateReady, StateUploading, false},
+		{StateDownloading, StateCompleted, true},
+		{StateDownloading, StateReady, true},
+		{StateDownloading, StateDeclined, false},
+		{StateCompleted, StateFailed, false},
+		{StateCancelled, StateReady, false},
+	}
+	for _, test := range tests {
+		if ok := test.from.CanTransition(test.to); ok != test.ok {
+			t.Errorf("%v to %v got %v expected %v", test.from, test.to, ok, test.ok)
+		}
+	}
+}
+
+func TestTransferEvents(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+
+	fileBytes := []byte(RandomString(100))
+	initUpload := sendV1(t, user1, header1, InitUploadRequest{Codes: []string{user2.Code}}, fileBytes)
+	var filePath string
+	_ = s.db.QueryRow(`SELECT file_path FROM transfer WHERE id = ?`, initUpload.TransferID).Scan(&filePath)
+
+	// a download that can't be served does not start
+	rangeHeader := header2.Clone()
+	rangeHeader.Set("Range", "bytes=1000-")
+	rr := postRequestWithHeader(url.Values{"file_path": {filePath}}, rangeHeader, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 416 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 416)
+	}
+	rr = postRequestWithHeader(url.Values{"file_path": {filePath}}, header2, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	rr = postJSON(CompleteDownloadRequest{FilePath: filePath, Hash: HashWithBytes(fileBytes)}, header2,
+		http.HandlerFunc(s.V1CompletedDownloadHandler))
+	if rr.Code != 200 {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+
+	// both users can see the transitions
+	rr = postJSON(TransferEventsRequest{TransferID: initUpload.TransferID}, header2,
+		http.HandlerFunc(s.V1TransferEventsHandler))
+	var events []TransferEvent
+	if err := json.Unmarshal(rr.Body.Bytes(), &events); rr.Code != 200 || err != nil {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	rr = postRequestWithHeader(url.Values{"transfer_id": {strconv.FormatInt(initUpload.TransferID, 10)}}, header1,
+		http.HandlerFunc(s.TransferEventsHandler))
+	if rr.Code != 200 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	_, header3 := v1User(t)
+	rr = postJSON(TransferEventsRequest{TransferID: initUpload.TransferID}, header3,
+		http.HandlerFunc(s.V1TransferEventsHandler))
+	if e := readError(rr); rr.Code != 404 || e.Code != ErrTransferNotFound.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+
+	expected := []TransferState{StateUploading, StateReady, StateDownloading, StateCompleted}
+	if len(events) != len(expected) {
+		t.Fatalf("got %+v expected transitions to %v", events, expected)
+	}
+	from := StateInitialised
+	for i, event := range events {
+		if event.From != from || event.To != expected[i] || event.Reason == "" || event.Time.IsZero() {
+			t.Errorf("got %+v expected %v to %v", event, from, expected[i])
+		}
+		from = event.To
+	}
+
+	// a completed transfer can't change
+	transfer := Transfer{ID: initUpload.TransferID}
+	updated := false
+	update := func(tx *sql.Tx) error {
+		updated = true
+		return nil
+	}
+	if changed, err := transfer.Transition(s.db, StateCompleted, "foo", update); changed || err != nil || updated {
+		t.Errorf("expected moving to the same state to do nothing got %v %v", changed, err)
+	}
+	_, err := transfer.Transition(s.db, StateCancelled, "foo", update)
+	if e, ok := err.(APIError); !ok || e.Code != ErrIllegalTransition.Code || updated {
+		t.Errorf("got %v expected %v", err, ErrIllegalTransition)
+	}
+	if events, _ := GetTransferEvents(s.db, initUpload.TransferID); len(events) != len(expected) {
+		t.Errorf("got %+v", events)
+	}
+}
+
+func TestMaxDownloads(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	_, deviceHeader := registerDevice(t, header2)
+	senderWs := connectDeviceWSS(header1)
+	defer senderWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	rr := postJSON(InitUploadRequest{Filesize: 10, Codes: []string{user2.Code}, MaxDownloads: maxTransferDownloads + 1},
+		header1, http.HandlerFunc(s.V1InitUploadHandler))
+	if e := readError(rr); rr.Code != 400 || e.Code != ErrInvalidMaxDownloads.Code {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 400)
+	}
+
+	fileBytes := []byte(RandomString(100))
+	initUpload := sendV1(t, user1, header1, InitUploadRequest{Codes: []string{user2.Code}, MaxDownloads: 2}, fileBytes)
+	var filePath string
+	_ = s.db.QueryRow(`SELECT file_path FROM transfer WHERE id = ?`, initUpload.TransferID).Scan(&filePath)
+
+	// the file can be downloaded once by each device
+	for i, header := range []http.Header{header2, deviceHeader} {
+		rr = postRequestWithHeader(url.Values{"file_path": {filePath}}, header, http.HandlerFunc(s.DownloadHandler))
+		if rr.Code != 200 || rr.Body.String() != string(fileBytes) {
+			t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+		}
+		rr = postJSON(CompleteDownloadRequest{FilePath: filePath, Hash: HashWithBytes(fileBytes)}, header,
+			http.HandlerFunc(s.V1CompletedDownloadHandler))
+		if rr.Code != 200 {
+			t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+		}
+
+		var message DesktopMessage
+		readSocketFrameType(t, senderWs, socketTypeMessage, &message)
+		if i == 0 && message.Title != "Downloaded Transfer" || i == 1 && message.Title != "Successful Transfer" {
+			t.Errorf("got %+v", message)
+		}
+	}
+
+	rr = postRequestWithHeader(url.Values{"file_path": {filePath}}, header2, http.HandlerFunc(s.DownloadHandler))
+	if rr.Code != 404 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 404)
+	}
+	if _, err := fileStorage.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("expected the file to be deleted got %v", err)
+	}
+	events, _ := GetTransferEvents(s.db, initUpload.TransferID)
+	if len(events) != 6 || events[3].To != StateReady || events[5].To != StateCompleted {
+		t.Errorf("got %+v", events)
+	}
+	if _, err := (Transfer{ID: initUpload.TransferID}).downloaded(s.db); err == nil {
+		t.Errorf("expected no downloads to be left")
+	}
+}
+
+func TestExpiredMaxDownloads(t *testing.T) {
+	for _, downloads := range []int{0, 1} {
+		user1, header1 := v1User(t)
+		user2, header2 := v1User(t)
+		senderWs := connectDeviceWSS(header1)
+		time.Sleep(time.Millisecond * time.Duration(10))
+
+		fileBytes := []byte(RandomString(100))
+		initUpload := sendV1(t, user1, header1, InitUploadRequest{Codes: []string{user2.Code}, MaxDownloads: 2},
+			fileBytes)
+		var filePath string
+		_ = s.db.QueryRow(`SELECT file_path FROM transfer WHERE id = ?`, initUpload.TransferID).Scan(&filePath)
+		if downloads > 0 {
+			rr := postJSON(CompleteDownloadRequest{FilePath: filePath, Hash: HashWithBytes(fileBytes)}, header2,
+				http.HandlerFunc(s.V1CompletedDownloadHandler))
+			if rr.Code != 200 {
+				t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+			}
+			var message DesktopMessage
+			readSocketFrameType(t, senderWs, socketTypeMessage, &message)
+		}
+
+		// a transfer that expires is only a success if it was downloaded
+		transfer := Transfer{FilePath: filePath, from: user1, to: user2}
+		transfer.Completed(s.db, true, true)
+		var message DesktopMessage
+		readSocketFrameType(t, senderWs, socketTypeMessage, &message)
+		if downloads == 0 && message.Title != "Expired Transfer!" || downloads > 0 && message.Title != "Successful Transfer" {
+			t.Errorf("got %+v after %v downloads", message, downloads)
+		}
+		senderWs.Close()
+	}
+}
+
+func TestTransferRetention(t *testing.T) {
+	user1, header1 := v1User(t)
+	user2, header2 := v1User(t)
+	recipientWs := connectDeviceWSS(header2)
+	defer recipientWs.Close()
+	time.Sleep(time.Millisecond * time.Duration(10))
+
+	stats := User{UUID: user1.UUID}
+	stats.SetStats(s.db)
+	for _, test := range []struct {
+		retentionMins int
+		status        int
+		code          string
+	}{
+		{-1, 400, ErrInvalidRetention.Code},
+		{stats.RetentionMinsAllowed + 1, 402, ErrInsufficientCredit.Code},
+	} {
+		rr := postJSON(InitUploadRequest{Filesize: 10, Codes: []string{user2.Code}, RetentionMins: test.retentionMins},
+			header1, http.HandlerFunc(s.V1InitUploadHandler))
+		if e := readError(rr); rr.Code != test.status || e.Code != test.code {
+			t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, test.status)
+		}
+	}
+
+	// the file is kept for as long as the sender chose rather than the lifetime of their code
+	retentionMins := stats.RetentionMinsAllowed
+	initUpload := sendV1(t, user1, header1, InitUploadRequest{Codes: []string{user2.Code}, RetentionMins: retentionMins},
+		[]byte(RandomString(100)))
+	var offer Transfer
+	readSocketFrameType(t, recipientWs, socketTypeDownloadOffer, &offer)
+	expiry := time.Now().Add(time.Minute * time.Duration(retentionMins))
+	if offer.Expiry.Sub(expiry) > time.Minute || expiry.Sub(offer.Expiry) > time.Minute {
+		t.Errorf("got %v expected %v", offer.Expiry, expiry)
+	}
+
+	rr := postJSON(CancelRequest{TransferID: initUpload.TransferID}, header1, http.HandlerFunc(s.V1CancelHandler))
+	if rr.Code != 204 {
+		t.Errorf("Got %v (%v) expected %v", rr.Code, rr.Body, 204)
+	}
+
+	// a transfer that is still being uploaded does not expire
+	rr = postJSON(InitUploadRequest{Filesize: 10, Codes: []string{user2.Code}}, header1,
+		http.HandlerFunc(s.V1InitUploadHandler))
+	var pending InitUploadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &pending); rr.Code != 200 || err != nil {
+		t.Fatalf("Got %v (%v) expected %v", rr.Code, rr.Body, 200)
+	}
+	var pendingExpiry sql.NullTime
+	err := s.db.QueryRow(`SELECT expiry_dttm FROM transfer WHERE id = ?`, pending.TransferID).Scan(&pendingExpiry)
+	if err != nil || pendingExpiry.Valid {
+		t.Errorf("got %v %v expected no expiry", pendingExpiry, err)
+	}
+}
@@ -12,6 +12,8 @@ const keyUUIDLen = 200
 const (
 	defaultAccountLifeMins = 10
 	maxAccountLifeMins     = 60
+
+	defaultRetentionMins = 60
 )
 const (
 	freeUserTier       = 0
@@ -27,9 +29,11 @@ const (
 
 // User structure
 type User struct {
-	ID            int       `json:"-"`
-	PublicKey     string    `json:"-"`
-	UUID          string    `json:"-"`
+	ID        int    `json:"-"`
+	PublicKey string `json:"-"`
+	UUID      string `json:"-"`
+	// the registered device making the request or empty for the device that created the account
+	DeviceID      string    `json:"-"`
 	Code          string    `json:"user_code"`
 	BandwidthLeft int       `json:"bw_left"`
 	MaxFileSize   int       `json:"max_fs"`
@@ -39,6 +43,9 @@ type User struct {
 	Tier          int       `json:"user_tier"`
 	Credit        float64   `json:"credit"`
 	UUIDKey       string    `json:"UUID_key"`
+
+	// RetentionMinsAllowed is the longest a file sent by the user can be kept for before it is downloaded
+	RetentionMinsAllowed int `json:"retention_mins_allowed"`
 }
 
 // Store stores the permanent parts of the User struct in the database
@@ -92,6 +99,20 @@ func (user *User) GetMinsAllowed(db *sql.DB) {
 	}
 }
 
+// GetRetentionMinsAllowed gets the max minutes that a file sent by the user can be kept for
+func (user *User) GetRetentionMinsAllowed(db *sql.DB) {
+	user.GetTier(db)
+	if user.Tier == customCodeUserTier {
+		user.RetentionMinsAllowed = 60 * 24 * 7
+	} else if user.Tier == permUserTier {
+		user.RetentionMinsAllowed = 60 * 24 * 3
+	} else if user.Tier == paidUserTier {
+		user.RetentionMinsAllowed = 60 * 24
+	} else {
+		user.RetentionMinsAllowed = 60 * 12
+	}
+}
+
 // SetStats fetches all stored stats of a user
 func (user *User) SetStats(db *sql.DB) {
 	// get code time left
@@ -102,6 +123,7 @@ func (user *User) SetStats(db *sql.DB) {
 	}
 
 	user.GetMinsAllowed(db)
+	user.GetRetentionMinsAllowed(db)
 	user.GetTier(db)
 	user.GetBandwidthLeft(db)
 	user.GetMaxFileSize(db)
@@ -160,6 +182,14 @@ func (user *User) GetMaxFileSize(db *sql.DB) {
 	user.MaxFileSize = CreditToFileUploadSize(user.Credit)
 }
 
+// GetCode fetches the current code of the user
+func (user *User) GetCode(db *sql.DB) {
+	result := db.QueryRow(`SELECT IFNULL(code, '')
+	FROM user
+	WHERE UUID = ?`, Hash(user.UUID))
+	Handle(result.Scan(&user.Code))
+}
+
 // GetExpiry fetches the expiry date of the current code
 func (user *User) GetExpiry(db *sql.DB) {
 	result := db.QueryRow(`SELECT code_end_dttm
@@ -217,6 +247,17 @@ func getAllDisplayUsers(db *sql.DB) []displayUser {
 	return users
 }
 
+// GetPublicKey fetches the public key of the user returning false if the user does not exist
+func (user *User) GetPublicKey(db *sql.DB) bool {
+	err := db.QueryRow(`SELECT public_key
+	FROM user
+	WHERE UUID = ?`, Hash(user.UUID)).Scan(&user.PublicKey)
+	if err != sql.ErrNoRows {
+		Handle(err)
+	}
+	return err == nil
+}
+
 // CodeToUser converts a users code to a User.
 func CodeToUser(db *sql.DB, code string) (user User) {
 	if len(code) != codeLen {
@@ -245,18 +286,6 @@ func SetUsersPermCode(db *sql.DB, user *User, expectedPermCode string) {
 	}
 }
 
-// IsConnected will store if a user is connected to socket depending on `connected`
-func (user User) IsConnected(db *sql.DB, connected bool) {
-	isConnected := 1
-	if !connected {
-		isConnected = 0
-	}
-
-	Handle(UpdateErr(db.Exec(`UPDATE user
-	SET is_connected = ?
-	WHERE UUID = ?`, isConnected, Hash(user.UUID))))
-}
-
 func purgeCode(db *sql.DB, user User) {
 	_ = UpdateErr(db.Exec(`UPDATE user
 	SET code = NULL, code_end_dttm = NULL
@@ -276,7 +305,8 @@ func getUserUsedBandwidth(db *sql.DB, user User) (bytes int) {
 	result := db.QueryRow(`SELECT SUM(size) as used_bandwidth
 	FROM transfer
 	WHERE from_UUID = ? 
-	AND DATE(finished_dttm) = CURDATE()`, Hash(user.UUID))
+	AND DATE(finished_dttm) = CURDATE()
+	AND direct = 0`, Hash(user.UUID))
 	err := result.Scan(&bytes)
 	if err != nil {
 		bytes = 0
@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -146,26 +147,29 @@ func WriteJSON(w http.ResponseWriter, v interface{}) error {
 	return err
 }
 
-// WriteError will write a http.Error as well as logging the error locally and to Sentry
-func WriteError(w http.ResponseWriter, r *http.Request, code int, message string) {
+// WriteError will write err as JSON as well as logging the error locally and to Sentry
+func WriteError(w http.ResponseWriter, r *http.Request, err APIError) {
 	// find where this function has been called from
 	pc, _, line, _ := runtime.Caller(1)
 	details := runtime.FuncForPC(pc)
 	calledFrom := fmt.Sprintf("%s line:%d", details.Name(), line)
 
-	log.Printf("HTTP error: message: %s code: %d from:%s \n", message, code, calledFrom)
+	log.Printf("HTTP error: message: %s code: %s status: %d from:%s \n", err.Message, err.Code, err.Status, calledFrom)
 
 	// log to sentry
 	if hub := sentry.GetHubFromContext(r.Context()); hub != nil {
 		hub.WithScope(func(scope *sentry.Scope) {
 			scope.SetExtra("Called From", calledFrom)
-			scope.SetExtra("Header Code", code)
-			hub.CaptureMessage(message)
+			scope.SetExtra("Header Code", err.Status)
+			scope.SetExtra("Error Code", err.Code)
+			hub.CaptureMessage(err.Message)
 		})
 	}
 
-	http.Error(w, message, code)
-	w.Write([]byte(message))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(err.Status)
+	Handle(json.NewEncoder(w).Encode(err))
 }
 
 // InitSession initiates a http session
@@ -196,3 +200,43 @@ func BytesToReadable(bytes int) string {
 		units[int(base)],
 	)
 }
+
+// ParseRange parses a single byte range from a Range header for a file of size bytes. The returned end is inclusive.
+func ParseRange(header string, size int64) (start int64, end int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) || strings.Contains(header, ",") {
+		return
+	}
+	parts := strings.SplitN(strings.TrimSpace(header[len(prefix):]), "-", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	if parts[0] == "" {
+		// suffix range of the last n bytes
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+
+	first, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || first < 0 || first >= size {
+		return
+	}
+	last := size - 1
+	if parts[1] != "" {
+		last, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || last < first {
+			return
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	return first, last, true
+}
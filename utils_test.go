@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -93,3 +96,50 @@ func TestUpdateErr(t *testing.T) {
 		t.Errorf("Should have failed because of invalid SQL")
 	}
 }
+
+// ParseRange()
+var ranges = []struct {
+	header string
+	start  int64
+	end    int64
+	ok     bool
+}{
+	{"", 0, 0, false},
+	{"bytes=0-99", 0, 99, true},
+	{"bytes=10-", 10, 99, true},
+	{"bytes=-10", 90, 99, true},
+	{"bytes=-1000", 0, 99, true},
+	{"bytes=50-1000", 50, 99, true},
+	{"bytes=100-", 0, 0, false},
+	{"bytes=20-10", 0, 0, false},
+	{"bytes=0-1,5-6", 0, 0, false},
+	{"items=0-1", 0, 0, false},
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tt := range ranges {
+		t.Run(tt.header, func(t *testing.T) {
+			start, end, ok := ParseRange(tt.header, 100)
+			if start != tt.start || end != tt.end || ok != tt.ok {
+				t.Errorf("got %v-%v %v, wanted %v-%v %v", start, end, ok, tt.start, tt.end, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	req, _ := http.NewRequest("GET", "", nil)
+	rr := httptest.NewRecorder()
+	WriteError(rr, req, ErrFriendNotFound.WithMessage("foo"))
+
+	var e APIError
+	if err := json.Unmarshal(rr.Body.Bytes(), &e); err != nil {
+		t.Fatalf("expected a single JSON error got %v", rr.Body)
+	}
+	if rr.Code != 404 || e.Code != "friend_not_found" || e.Message != "foo" {
+		t.Errorf("got %v %v", rr.Code, e)
+	}
+	if ErrFriendNotFound.Message == "foo" {
+		t.Errorf("WithMessage should not change the catalogue")
+	}
+}
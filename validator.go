@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	uuid "github.com/satori/go.uuid"
+	"path"
 	"regexp"
 	"strings"
 )
@@ -47,3 +48,9 @@ func IsValidPublicKey(pubKey string) bool {
 	}
 	return true
 }
+
+// IsValidRelativePath checks p is a clean relative path that does not leave its directory
+func IsValidRelativePath(p string) bool {
+	return p != "" && p != "." && path.Clean(p) == p && !path.IsAbs(p) && p != ".." &&
+		!strings.HasPrefix(p, "../") && len(p) <= 1000
+}
@@ -59,3 +59,30 @@ func TestIsValidPublicKey(t *testing.T) {
 		})
 	}
 }
+
+var relativePaths = []struct {
+	in  string
+	out bool
+}{
+	{"", false},
+	{".", false},
+	{"..", false},
+	{"../a", false},
+	{"/a", false},
+	{"a/../b", false},
+	{"a//b", false},
+	{"a", true},
+	{"a/b.txt", true},
+	{"..a", true},
+}
+
+func TestIsValidRelativePath(t *testing.T) {
+	for _, tt := range relativePaths {
+		t.Run(tt.in, func(t *testing.T) {
+			v := IsValidRelativePath(tt.in)
+			if v != tt.out {
+				t.Errorf("got %v, wanted %v", v, tt.out)
+			}
+		})
+	}
+}